@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// admin.go
+// 诊断接口：/conflux/config 返回当前生效的配置概要，/conflux/logs 返回当前日志文件的最近若干行，
+// 均经 requireAdmin 鉴权（ADMIN_USER/ADMIN_PASS 或订阅 token）。
+
+// /conflux/logs 默认和最多返回的行数
+const (
+	defaultLogLines = 200
+	maxLogLines     = 5000
+)
+
+// 日志尾部最多读取的字节数，避免一次读入整个日志文件
+const maxLogTail = 1 << 20
+
+// 处理 /conflux/config：返回版本、机场名和参数名等配置概要，订阅链接含机场 token，不输出
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	airports := make([]string, 0)
+	for name := range loadAirports() {
+		airports = append(airports, name)
+	}
+	sort.Strings(airports)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"version":     Version,
+		"airports":    airports,
+		"token_param": tokenParam(),
+		"force_param": forceParam(),
+	})
+}
+
+// 处理 /conflux/logs：返回当前日志文件的最近 lines 行（默认 200，最多 5000）
+func handleLogs(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	n, err := strconv.Atoi(r.URL.Query().Get("lines"))
+	if err != nil || n <= 0 {
+		n = defaultLogLines
+	}
+	if n > maxLogLines {
+		n = maxLogLines
+	}
+	if logFile == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("log not available"))
+		return
+	}
+	lines, err := tailFile(logFile.Name(), n)
+	if err != nil {
+		Error("HTTP", "读取日志失败: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("read log error"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(strings.Join(lines, "\n")))
+}
+
+// 读取文件末尾最多 n 行（只读取最后 maxLogTail 字节，首行可能不完整时丢弃）
+func tailFile(path string, n int) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := info.Size() - maxLogTail
+	if offset < 0 {
+		offset = 0
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if offset > 0 && len(lines) > 0 {
+		lines = lines[1:]
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// debug.go
+// 调试端口：设置 PPROF_LISTEN（如 127.0.0.1:6060）时在独立端口提供 net/http/pprof 和运行时信息，
+// 用于排查大批量节点更新时的内存和 goroutine 泄漏。该端口不做鉴权，应只监听本机或内网地址。
+
+// 在 PPROF_LISTEN 启动调试服务，未设置时不启动；监听失败只记录警告，不影响主服务
+func startDebugServer() {
+	addr := os.Getenv("PPROF_LISTEN")
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/runtime", handleDebugRuntime)
+	Info("HTTP", "启动调试服务... 监听地址 %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		Warn("HTTP", "调试服务启动失败 (%s): %v", addr, err)
+	}
+}
+
+// 导入 net/http/pprof 时会向 DefaultServeMux 注册 /debug/pprof/，主服务中屏蔽这些路径，
+// 调试接口只在 PPROF_LISTEN 端口提供
+func hideDebug(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/debug/") {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 处理 /debug/runtime：返回 goroutine 数、内存和 GC 概况 JSON
+func handleDebugRuntime(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	updateStateMu.Lock()
+	running := updateRunning > 0
+	updateStateMu.Unlock()
+
+	info := map[string]interface{}{
+		"go_version":     runtime.Version(),
+		"uptime":         time.Since(startTime).Round(time.Second).String(),
+		"updating":       running,
+		"goroutines":     runtime.NumGoroutine(),
+		"heap_alloc":     mem.HeapAlloc,
+		"heap_inuse":     mem.HeapInuse,
+		"heap_objects":   mem.HeapObjects,
+		"sys":            mem.Sys,
+		"total_alloc":    mem.TotalAlloc,
+		"num_gc":         mem.NumGC,
+		"gc_pause_total": time.Duration(mem.PauseTotalNs).String(),
+	}
+	if mem.LastGC > 0 {
+		info["last_gc"] = time.Unix(0, int64(mem.LastGC))
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(info)
+}
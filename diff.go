@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// diff.go
+// 更新差异：每次写入 node.conf 前将旧内容保存为 node.conf.prev，
+// /conflux/diff 比较最近两次更新的结果，返回新增、移除和变化的节点（JSON）或 unified diff 文本。
+
+const prevNodeConfPath = "/data/conflux/node.conf.prev"
+
+// 逐行比较时 DP 表的最大单元数，超出时中间部分按整体删除再新增处理，避免大文件占用过多内存
+const maxDiffCells = 4 << 20
+
+// 节点变化：同一节点（类型 + 服务器 + 端口）的名称或参数发生变化
+type nodeChange struct {
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// 差异结果
+type nodeDiff struct {
+	Previous time.Time    `json:"previous"`
+	Current  time.Time    `json:"current"`
+	Added    []string     `json:"added"`
+	Removed  []string     `json:"removed"`
+	Changed  []nodeChange `json:"changed"`
+}
+
+// 写入新 node.conf 前保存旧内容，失败只记录警告
+func savePreviousNodeConf(nodeConfPath string) {
+	data, err := readDataFile(nodeConfPath)
+	if err != nil {
+		return
+	}
+	if err := writeDataFile(prevNodeConfPath, data); err != nil {
+		Warn("UPDATE", "保存 node.conf.prev 失败: %v", err)
+	}
+}
+
+// 读取 node.conf 中的节点行，忽略空行和注释
+func nodeConfLines(path string) ([]string, error) {
+	lines, err := loadNodeConf(path)
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			result = append(result, line)
+		}
+	}
+	return result, nil
+}
+
+// 节点行的比较键：类型 + 服务器 + 端口（同 stableID），同键的多行按出现顺序编号
+func diffKeys(lines []string) ([]string, map[string]string) {
+	keys := make([]string, 0, len(lines))
+	byKey := make(map[string]string)
+	seen := make(map[string]int)
+	for _, line := range lines {
+		key := line
+		if n, ok := parseNodeLine(line, lineAirport(line)); ok {
+			key = stableID(n)
+		}
+		seen[key]++
+		key = fmt.Sprintf("%s#%d", key, seen[key])
+		keys = append(keys, key)
+		byKey[key] = line
+	}
+	return keys, byKey
+}
+
+// 按节点比较两次结果
+func diffNodes(prev, cur []string) nodeDiff {
+	d := nodeDiff{Added: []string{}, Removed: []string{}, Changed: []nodeChange{}}
+	prevKeys, prevByKey := diffKeys(prev)
+	curKeys, curByKey := diffKeys(cur)
+	for _, key := range curKeys {
+		before, ok := prevByKey[key]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, curByKey[key])
+		case before != curByKey[key]:
+			d.Changed = append(d.Changed, nodeChange{Before: before, After: curByKey[key]})
+		}
+	}
+	for _, key := range prevKeys {
+		if _, ok := curByKey[key]; !ok {
+			d.Removed = append(d.Removed, prevByKey[key])
+		}
+	}
+	return d
+}
+
+// 逐行编辑操作：' ' 不变，'-' 删除，'+' 新增
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// 计算逐行编辑序列：去掉公共前后缀后对中间部分求最长公共子序列
+func diffLines(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var ops []diffOp
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(ma)*len(mb) > maxDiffCells {
+		for _, line := range ma {
+			ops = append(ops, diffOp{'-', line})
+		}
+		for _, line := range mb {
+			ops = append(ops, diffOp{'+', line})
+		}
+	} else {
+		ops = append(ops, lcsOps(ma, mb)...)
+	}
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+// 最长公共子序列回溯出编辑序列（同一位置先输出删除再输出新增）
+func lcsOps(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	// table[i][j] 为 a[i:] 与 b[j:] 的最长公共子序列长度
+	table := make([][]int32, n+1)
+	for i := range table {
+		table[i] = make([]int32, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				table[i][j] = table[i+1][j+1] + 1
+			} else if table[i+1][j] >= table[i][j+1] {
+				table[i][j] = table[i+1][j]
+			} else {
+				table[i][j] = table[i][j+1]
+			}
+		}
+	}
+	var ops []diffOp
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case table[i+1][j] >= table[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < m; j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+	return ops
+}
+
+// 输出 unified diff，每个变化块前后保留 context 行上下文
+func writeUnifiedDiff(w io.Writer, d nodeDiff, ops []diffOp, context int) {
+	const layout = "2006-01-02 15:04:05 -0700"
+	fmt.Fprintf(w, "--- node.conf.prev\t%s\n+++ node.conf\t%s\n", d.Previous.Format(layout), d.Current.Format(layout))
+
+	// oldLine/newLine 为每个操作之前已消耗的旧/新行数
+	oldLine, newLine := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	for k, op := range ops {
+		oldLine[k+1], newLine[k+1] = oldLine[k], newLine[k]
+		if op.kind != '+' {
+			oldLine[k+1]++
+		}
+		if op.kind != '-' {
+			newLine[k+1]++
+		}
+	}
+
+	for k := 0; k < len(ops); {
+		if ops[k].kind == ' ' {
+			k++
+			continue
+		}
+		// 变化块：向前取上下文，向后合并间隔不超过 2*context 的后续变化
+		start := k - context
+		if start < 0 {
+			start = 0
+		}
+		end := k
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+			if next == len(ops) || next-end > 2*context {
+				break
+			}
+			end = next
+		}
+		stop := end + context
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		oldCount, newCount := oldLine[stop]-oldLine[start], newLine[stop]-newLine[start]
+		oldStart, newStart := oldLine[start], newLine[start]
+		if oldCount > 0 {
+			oldStart++
+		}
+		if newCount > 0 {
+			newStart++
+		}
+		fmt.Fprintf(w, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+		for _, op := range ops[start:stop] {
+			fmt.Fprintf(w, "%c%s\n", op.kind, op.line)
+		}
+		k = stop
+	}
+}
+
+// 处理 /conflux/diff：比较最近两次更新的 node.conf，默认返回 JSON，format=diff 时返回 unified diff 文本
+// 尚无上次结果（首次更新前或只更新过一次）时返回 404
+func handleDiff(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	if !validateToken(r) {
+		Warn("HTTP", "Token 校验失败: %s", requestToken(r))
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("invalid token"))
+		return
+	}
+
+	nodeConfPath := "/data/conflux/node.conf"
+	cur, err := nodeConfLines(nodeConfPath)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("node.conf not found"))
+		return
+	}
+	prev, err := nodeConfLines(prevNodeConfPath)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("no previous update"))
+		return
+	}
+
+	d := diffNodes(prev, cur)
+	d.Previous, _ = dataFileModTime(prevNodeConfPath)
+	d.Current, _ = dataFileModTime(nodeConfPath)
+	w.Header().Set("Cache-Control", "no-store")
+	if r.URL.Query().Get("format") == "diff" {
+		w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+		writeUnifiedDiff(w, d, diffLines(prev, cur), 3)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(d)
+}
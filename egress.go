@@ -2,13 +2,21 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/metacubex/mihomo/adapter"
@@ -20,27 +28,166 @@ import (
 
 // egress 负责 geo 检测、出口检测、失败统计
 func egress(ctx *UpdateContext) {
-	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, 10) // 限制并发数
+	const concurrency = 10 // 限制并发数
 
+	threshold, cooldown := failStreakPolicy()
+	tasks := make(chan probeTask, len(ctx.Nodes))
+	pending := make(map[int]bool)
 	for i := range ctx.Nodes {
-		wg.Add(1)
-		go func(index int) {
-			defer wg.Done()
-			semaphore <- struct{}{}        // 获取信号量
-			defer func() { <-semaphore }() // 释放信号量
+		// 连续失败达到阈值且仍在冷却期内的节点直接跳过，冷却期过后重新检测
+		if m := ctx.Meta[stableID(ctx.Nodes[i])]; threshold > 0 && m != nil &&
+			m.FailStreak >= threshold && time.Since(m.LastFail) < cooldown {
+			Info("EGRESS", "[%s] %s: 连续失败 %d 次，冷却期内跳过", ctx.Nodes[i].Source, ctx.Nodes[i].OriginName, m.FailStreak)
+			updateFailedCount(ctx.Nodes[i].Source, ctx)
+			ctx.dropNode(ctx.Nodes[i], DropBlocked)
+			continue
+		}
+		tasks <- probeTask{index: i, node: ctx.Nodes[i]}
+		pending[i] = true
+	}
+	close(tasks)
+	total, geoPassed := len(pending), 0
+
+	// 检测协程只使用任务中的节点副本和独立的统计，不访问 ctx，结果汇总到主协程后再合并，
+	// 软截止（EGRESS_SOFT_DEADLINE）时取消 probeCtx，进行中的拨号和请求随之中止，
+	// 等全部检测协程退出后才继续修改 ctx.Nodes，结果不再合并到 ctx
+	results := make(chan probeResult, len(ctx.Nodes))
+	probeCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var workers sync.WaitGroup
+	worker := func() {
+		defer workers.Done()
+		for task := range tasks {
+			if probeCtx.Err() != nil {
+				return
+			}
+			node := task.node
+			scratch := &UpdateContext{
+				AirportStats: map[string]*Stat{node.Source: {}},
+				Dropped:      make(map[string][]DropRecord),
+			}
+			probeNode(probeCtx, &node, scratch)
+			results <- probeResult{index: task.index, node: node, scratch: scratch}
+		}
+	}
+
+	// 启动检测协程；EGRESS_RAMP=1 时分批逐步启动，避免瞬间并发冲击网络栈和检测接口
+	step, interval := egressRamp(concurrency)
+	for started := 0; started < concurrency; {
+		for j := 0; j < step && started < concurrency; j++ {
+			started++
+			workers.Add(1)
+			go worker()
+		}
+		if started < concurrency {
+			time.Sleep(interval)
+		}
+	}
+
+	var deadline <-chan time.Time
+	if d, err := time.ParseDuration(os.Getenv("EGRESS_SOFT_DEADLINE")); err == nil && d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+collect:
+	for len(pending) > 0 {
+		select {
+		case r := <-results:
+			delete(pending, r.index)
+			ctx.Nodes[r.index] = r.node
+			if r.node.ISO != "" {
+				geoPassed++
+			}
+			publishEvent("geo", map[string]interface{}{"done": total - len(pending), "total": total, "passed": geoPassed})
+			for source, stat := range r.scratch.AirportStats {
+				total := ctx.AirportStats[source]
+				total.Failed += stat.Failed
+				total.ConnectFailed += stat.ConnectFailed
+				total.ReadFailed += stat.ReadFailed
+				total.GeoFailed += stat.GeoFailed
+			}
+			for source, records := range r.scratch.Dropped {
+				ctx.Dropped[source] = append(ctx.Dropped[source], records...)
+			}
+		case <-deadline:
+			cancel()
+			workers.Wait()
+			Warn("EGRESS", "超过软截止时间，放弃剩余 %d 个节点的检测", len(pending))
+			for index := range pending {
+				updateFailedCount(ctx.Nodes[index].Source, ctx)
+				ctx.dropNode(ctx.Nodes[index], DropDeadline)
+			}
+			break collect
+		}
+	}
 
-			node := &ctx.Nodes[index]
-			detectNodeGeo(node, ctx)
-		}(i)
+	// 更新节点元数据：成功时失败计数清零并记录延迟，失败累加（冷却期内跳过和超过软截止未检测的节点不重复累加）
+	// GEO_GRACE=N 时，曾经检测成功的节点连续失败不超过 N 次仍保留，沿用上次的 ISO
+	historySize := latencyHistorySize()
+	grace, _ := strconv.Atoi(os.Getenv("GEO_GRACE"))
+	meta := make(map[string]*NodeMeta)
+	for i := range ctx.Nodes {
+		node := &ctx.Nodes[i]
+		id := stableID(*node)
+		m := ctx.Meta[id]
+		if m == nil {
+			m = &NodeMeta{}
+		}
+		if node.ISO != "" && node.Emoji != "" {
+			m.FailStreak = 0
+			if historySize > 0 && node.Latency > 0 {
+				m.Latencies = append(m.Latencies, node.Latency.Milliseconds())
+			}
+			m.LastISO, m.LastEmoji = node.ISO, node.Emoji
+		} else if !pending[i] && (threshold == 0 || m.FailStreak < threshold || time.Since(m.LastFail) >= cooldown) {
+			m.FailStreak++
+			m.LastFail = time.Now()
+			if grace > 0 && m.LastISO != "" && m.FailStreak <= grace {
+				Info("EGRESS", "[%s] %s: 连续失败 %d/%d 次，沿用上次 ISO %s", node.Source, node.OriginName, m.FailStreak, grace, m.LastISO)
+				node.ISO, node.Emoji = m.LastISO, m.LastEmoji
+				ctx.restoreNode(*node)
+			}
+		}
+		// 延迟历史只保留最近 LATENCY_HISTORY 次
+		if historySize == 0 {
+			m.Latencies = nil
+		} else if len(m.Latencies) > historySize {
+			m.Latencies = m.Latencies[len(m.Latencies)-historySize:]
+		}
+		if grace <= 0 {
+			m.LastISO, m.LastEmoji = "", ""
+		}
+		if m.FailStreak > 0 || len(m.Latencies) > 0 || m.LastISO != "" {
+			meta[id] = m
+		}
 	}
+	ctx.Meta = meta
 
-	wg.Wait()
+	// 统计每个机场的检测数和成功数
+	tested := make(map[string]int)
+	passed := make(map[string]int)
+	for _, node := range ctx.Nodes {
+		tested[node.Source]++
+		if node.ISO != "" && node.Emoji != "" {
+			passed[node.Source]++
+		}
+	}
+
+	// 成功率低于 MIN_SUCCESS_RATIO 的机场本次结果不可靠，丢弃并沿用上次节点
+	if ratio := minSuccessRatio(); ratio > 0 {
+		for airport, n := range tested {
+			if r := float64(passed[airport]) / float64(n); r < ratio {
+				Warn("EGRESS", "[%s] 成功率 %.2f 低于阈值 %.2f，丢弃本次节点", airport, r, ratio)
+				ctx.Retained[airport] = true
+			}
+		}
+	}
 
 	// 过滤掉检测失败的节点
 	successfulNodes := []Node{}
 	for _, node := range ctx.Nodes {
-		if node.ISO != "" && node.Emoji != "" {
+		if node.ISO != "" && node.Emoji != "" && !ctx.Retained[node.Source] {
 			successfulNodes = append(successfulNodes, node)
 		}
 	}
@@ -60,37 +207,231 @@ func egress(ctx *UpdateContext) {
 
 	// 输出每个机场的统计日志
 	for airport, stat := range ctx.AirportStats {
-		Info("EGRESS", "[%s] 总数=%d 去重=%d 失败=%d", airport, stat.Total, stat.Duplicated, stat.Failed)
+		Info("EGRESS", "[%s] 总数=%d 去重=%d 失败=%d（连接=%d 读取=%d 出口=%d）", airport, stat.Total, stat.Duplicated, stat.Failed,
+			stat.ConnectFailed, stat.ReadFailed, stat.GeoFailed)
 	}
+
+	// 统计存活节点的出口地区分布
+	ctx.Regions = make(map[string]int)
+	for _, node := range ctx.Nodes {
+		ctx.Regions[node.ISO]++
+	}
+	Info("EGRESS", "出口地区分布: %s", formatRegions(ctx.Regions))
 }
 
-// detectNodeGeo 检测单个节点的地理位置
-func detectNodeGeo(node *Node, ctx *UpdateContext) {
+// formatRegions 按节点数降序（相同时按 ISO）格式化地区分布，如 "HK:42 JP:30 US:18"
+func formatRegions(regions map[string]int) string {
+	isos := make([]string, 0, len(regions))
+	for iso := range regions {
+		isos = append(isos, iso)
+	}
+	sort.Slice(isos, func(i, j int) bool {
+		if regions[isos[i]] != regions[isos[j]] {
+			return regions[isos[i]] > regions[isos[j]]
+		}
+		return isos[i] < isos[j]
+	})
+	parts := make([]string, len(isos))
+	for i, iso := range isos {
+		parts[i] = fmt.Sprintf("%s:%d", iso, regions[iso])
+	}
+	return strings.Join(parts, " ")
+}
+
+// 单个节点的检测任务：节点副本，检测协程不读取 ctx.Nodes
+type probeTask struct {
+	index int
+	node  Node
+}
+
+// 单个节点的检测结果：检测后的节点副本及其失败统计和丢弃记录
+type probeResult struct {
+	index   int
+	node    Node
+	scratch *UpdateContext
+}
+
+// egressRamp 读取检测协程的启动节奏：未启用 EGRESS_RAMP 时一次性启动全部协程
+// 启用时每隔 EGRESS_RAMP_INTERVAL（默认 100ms）启动 EGRESS_RAMP_STEP（默认 2）个协程
+func egressRamp(concurrency int) (int, time.Duration) {
+	if os.Getenv("EGRESS_RAMP") != "1" {
+		return concurrency, 0
+	}
+	step, err := strconv.Atoi(os.Getenv("EGRESS_RAMP_STEP"))
+	if err != nil || step <= 0 {
+		step = 2
+	}
+	interval, err := time.ParseDuration(os.Getenv("EGRESS_RAMP_INTERVAL"))
+	if err != nil || interval <= 0 {
+		interval = 100 * time.Millisecond
+	}
+	return step, interval
+}
+
+// failStreakPolicy 读取连续失败跳过策略：FAIL_STREAK 阈值（0 表示不启用）和 FAIL_COOLDOWN 冷却期（默认 24h）
+func failStreakPolicy() (int, time.Duration) {
+	threshold, _ := strconv.Atoi(os.Getenv("FAIL_STREAK"))
+	cooldown, err := time.ParseDuration(os.Getenv("FAIL_COOLDOWN"))
+	if err != nil || cooldown <= 0 {
+		cooldown = 24 * time.Hour
+	}
+	return threshold, cooldown
+}
+
+// minSuccessRatio 读取 MIN_SUCCESS_RATIO（0~1），未设置或非法时返回 0 表示不启用
+func minSuccessRatio() float64 {
+	ratio, err := strconv.ParseFloat(os.Getenv("MIN_SUCCESS_RATIO"), 64)
+	if err != nil || ratio <= 0 || ratio > 1 {
+		return 0
+	}
+	return ratio
+}
+
+// probeNode 单个节点的出口检测，测试中可替换
+var probeNode = detectNodeGeo
+
+// detectNodeGeo 检测单个节点的地理位置，probeCtx 取消时中止进行中的拨号和请求
+func detectNodeGeo(probeCtx context.Context, node *Node, ctx *UpdateContext) {
 	// 转换 Surge 参数格式
 	proxyMap := convertNodeToProxyMap(node)
 
 	// 创建代理客户端
-	client := createProxyClient(proxyMap)
+	dialer := probeDialer(node)
+	client := createProxyClient(proxyMap, dialer)
 	if client == nil {
 		Warn("EGRESS", "[%s] %s: 创建代理客户端失败", node.Source, node.OriginName)
 		updateFailedCount(node.Source, ctx)
+		ctx.dropNode(*node, DropDial)
 		return
 	}
 
+	// 节点自带 HTTPS test-url 时优先用它检测可达性和延迟，ISO 仍只从 Cloudflare trace 获取
+	var latency time.Duration
+	var err error
+	if testURL := nodeTestURL(node.Params); testURL != "" {
+		latency, err = probeTestURL(probeCtx, client, testURL, node.Params["test-timeout"])
+		if err != nil {
+			Warn("EGRESS", "[%s] %s: test-url 检测失败 - %v", node.Source, node.OriginName, err)
+			updateFailedCount(node.Source, ctx)
+			ctx.dropNode(*node, probeDropReason(err))
+			return
+		}
+	}
+
+	// PROBE=urltest 时先用 mihomo 自带的 URL 测试检测可达性和延迟（已通过 test-url 检测的节点除外）
+	// 内置测试不支持自定义拨号器，设置 BIND_ADDR 或节点所属机场配置了 PROBE_FRONT 时回退到原有方式
+	if err == nil && latency == 0 && os.Getenv("PROBE") == "urltest" && dialer == nil {
+		latency, err = urlTestProxy(probeCtx, proxyMap)
+		if err != nil {
+			Warn("EGRESS", "[%s] %s: URL 测试失败 - %v", node.Source, node.OriginName, err)
+			updateFailedCount(node.Source, ctx)
+			ctx.dropNode(*node, probeDropReason(err))
+			return
+		}
+	}
+
 	// 通过代理访问 Cloudflare trace 接口获取 ISO
-	iso, err := getProxyISO(client)
+	iso, traceLatency, err := getProxyISO(probeCtx, client)
+	if latency == 0 {
+		latency = traceLatency
+	}
 	if err != nil {
 		Warn("EGRESS", "[%s] %s: 获取 ISO 失败 - %v", node.Source, node.OriginName, err)
 		updateFailedCount(node.Source, ctx)
+		ctx.dropNode(*node, probeDropReason(err))
 		return
 	}
 
-	// 根据 ISO 计算 emoji
+	// 根据 ISO 计算 emoji：统一转为大写，非法代码（非字母等）视为检测失败
+	iso = strings.ToUpper(strings.TrimSpace(iso))
 	emoji := getEmojiByISO(iso)
+	if emoji == "" {
+		Warn("EGRESS", "[%s] %s: ISO 代码非法 - %q", node.Source, node.OriginName, iso)
+		updateFailedCount(node.Source, ctx)
+		ctx.dropNode(*node, DropGeo)
+		return
+	}
 
 	// 更新节点信息
 	node.ISO = iso
 	node.Emoji = emoji
+	node.Tested = time.Now()
+	node.Latency = latency
+	if latency > 0 {
+		egressLatency.observe(latency.Seconds(), node.Source)
+	}
+
+	// CERT_CHECK=1 时记录 TLS 节点的证书信息
+	if os.Getenv("CERT_CHECK") == "1" && usesTLS(node) {
+		checkNodeCert(node)
+	}
+}
+
+// usesTLS 判断节点是否基于 TCP 上的 TLS（QUIC 类协议不在此列）
+func usesTLS(node *Node) bool {
+	switch node.Type {
+	case "trojan", "https":
+		return true
+	}
+	v := node.Params["tls"]
+	return v == "true" || v == "1"
+}
+
+// checkNodeCert 直连节点完成 TLS 握手，记录证书 CN/SAN/到期时间
+// 证书将在 CERT_WARN_DAYS（默认 7）天内到期或与 SNI 不匹配时输出警告
+func checkNodeCert(node *Node) {
+	serverName := node.Params["sni"]
+	if serverName == "" && !isIP(node.Server) {
+		serverName = node.Server
+	}
+	dialer := &tls.Dialer{
+		NetDialer: newDialer(),
+		Config: &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true, // 仅读取证书信息，不做校验
+		},
+	}
+	dialer.NetDialer.Timeout = 3 * time.Second
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(node.Server, node.Port))
+	if err != nil {
+		Warn("EGRESS", "[%s] %s: 证书检测失败 - %v", node.Source, node.OriginName, err)
+		return
+	}
+	defer conn.Close()
+
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return
+	}
+	leaf := certs[0]
+	node.CertCN = leaf.Subject.CommonName
+	node.CertSANs = leaf.DNSNames
+	node.CertExpiry = leaf.NotAfter
+
+	warnDays, err := strconv.Atoi(os.Getenv("CERT_WARN_DAYS"))
+	if err != nil || warnDays <= 0 {
+		warnDays = 7
+	}
+	if remaining := time.Until(leaf.NotAfter); remaining < time.Duration(warnDays)*24*time.Hour {
+		Warn("EGRESS", "[%s] %s: 证书将于 %s 到期", node.Source, node.OriginName, leaf.NotAfter.Format("2006-01-02"))
+	}
+	if serverName != "" && leaf.VerifyHostname(serverName) != nil {
+		Warn("EGRESS", "[%s] %s: 证书与 SNI %s 不匹配", node.Source, node.OriginName, serverName)
+	}
+}
+
+// probeDropReason 将出口检测错误分类映射为丢弃原因
+func probeDropReason(err error) string {
+	var pe *probeError
+	if errors.As(err, &pe) {
+		switch pe.kind {
+		case probeConnect:
+			return DropDial
+		case probeRead:
+			return DropRead
+		}
+	}
+	return DropGeo
 }
 
 // convertNodeToProxyMap 将 Node 转换为代理映射，处理参数转换
@@ -118,10 +459,111 @@ func convertNodeToProxyMap(node *Node) map[string]interface{} {
 		newValue := convertParamValue(v)
 		proxyMap[newKey] = newValue
 	}
+	convertTransport(node, proxyMap)
+	if node.Type == "wireguard" {
+		convertWireGuard(node, proxyMap)
+	}
+	if node.Type == "snell" {
+		convertSnell(node, proxyMap)
+	}
+	if node.Type == "ss" {
+		convertSSPlugin(node, proxyMap)
+	}
 
 	return proxyMap
 }
 
+// convertTransport 将 Surge 的 ws、sni、TUIC 版本、hysteria2 混淆/端口跳跃和 reality 参数转换为 mihomo 写法
+func convertTransport(node *Node, proxyMap map[string]interface{}) {
+	if v := node.Params["ws"]; v == "true" || v == "1" {
+		wsOpts := map[string]interface{}{}
+		if path := node.Params["ws-path"]; path != "" {
+			wsOpts["path"] = path
+		}
+		if k, v, ok := strings.Cut(node.Params["ws-headers"], ":"); ok {
+			wsOpts["headers"] = map[string]interface{}{strings.TrimSpace(k): strings.TrimSpace(v)}
+		}
+		proxyMap["network"] = "ws"
+		proxyMap["ws-opts"] = wsOpts
+		delete(proxyMap, "ws")
+		delete(proxyMap, "ws-path")
+		delete(proxyMap, "ws-headers")
+	}
+	if node.Type == "vmess" || node.Type == "vless" {
+		if sni := node.Params["sni"]; sni != "" {
+			proxyMap["servername"] = sni
+			delete(proxyMap, "sni")
+		}
+	}
+	// TUIC：Surge 以 tuic / tuic-v5 区分版本，mihomo 统一为 tuic；alpn 为列表
+	if node.Type == "tuic" || node.Type == "tuic-v5" {
+		proxyMap["type"] = "tuic"
+		if alpn := node.Params["alpn"]; alpn != "" {
+			proxyMap["alpn"] = strings.Split(alpn, ";")
+		}
+	}
+	// hysteria2：salamander 混淆和端口跳跃（Surge 以 ; 分隔，mihomo 以 , 分隔）
+	if pw := node.Params["salamander-password"]; pw != "" {
+		proxyMap["obfs"] = "salamander"
+		proxyMap["obfs-password"] = pw
+		delete(proxyMap, "salamander-password")
+	}
+	if ports := node.Params["port-hopping"]; ports != "" {
+		proxyMap["ports"] = strings.ReplaceAll(strings.Trim(ports, `"`), ";", ",")
+		delete(proxyMap, "port-hopping")
+	}
+	if pbk := node.Params["reality-public-key"]; pbk != "" {
+		proxyMap["reality-opts"] = map[string]interface{}{
+			"public-key": pbk,
+			"short-id":   node.Params["reality-short-id"],
+		}
+		delete(proxyMap, "reality-public-key")
+		delete(proxyMap, "reality-short-id")
+	}
+}
+
+// convertSnell 将 snell 的 obfs/obfs-host 转换为 mihomo 的 obfs-opts
+// mihomo 目前只实现 snell v1~v3，更高版本的节点会在创建代理时失败
+func convertSnell(node *Node, proxyMap map[string]interface{}) {
+	mode := node.Params["obfs"]
+	if mode == "" {
+		return
+	}
+	opts := map[string]interface{}{"mode": mode}
+	if host := node.Params["obfs-host"]; host != "" {
+		opts["host"] = host
+	}
+	proxyMap["obfs-opts"] = opts
+	delete(proxyMap, "obfs")
+	delete(proxyMap, "obfs-host")
+}
+
+// convertSSPlugin 将 ss 的 obfs 和 shadow-tls 参数转换为 mihomo 的 plugin / plugin-opts
+func convertSSPlugin(node *Node, proxyMap map[string]interface{}) {
+	if mode := node.Params["obfs"]; mode != "" {
+		opts := map[string]interface{}{"mode": mode}
+		if host := node.Params["obfs-host"]; host != "" {
+			opts["host"] = host
+		}
+		proxyMap["plugin"] = "obfs"
+		proxyMap["plugin-opts"] = opts
+	}
+	if password := node.Params["shadow-tls-password"]; password != "" {
+		opts := map[string]interface{}{"password": password, "version": 3}
+		if sni := node.Params["shadow-tls-sni"]; sni != "" {
+			opts["host"] = sni
+		}
+		if v, err := strconv.Atoi(node.Params["shadow-tls-version"]); err == nil {
+			opts["version"] = v
+		}
+		proxyMap["plugin"] = "shadow-tls"
+		proxyMap["plugin-opts"] = opts
+	}
+	for _, k := range []string{"obfs", "obfs-host", "shadow-tls-password", "shadow-tls-sni", "shadow-tls-version"} {
+		delete(proxyMap, k)
+	}
+}
+
 // convertParamName 转换参数名
 func convertParamName(key string) string {
 	switch key {
@@ -160,8 +602,8 @@ func convertParamValue(value string) interface{} {
 	return value
 }
 
-// createProxyClient 创建代理客户端
-func createProxyClient(proxyMap map[string]interface{}) *http.Client {
+// createProxyClient 创建代理客户端，dialer 非空时经由 dialer 连接节点（见 probeDialer）
+func createProxyClient(proxyMap map[string]interface{}, dialer constant.Dialer) *http.Client {
 	// 使用 mihomo 库创建代理
 	proxy, err := adapter.ParseProxy(proxyMap)
 	if err != nil {
@@ -170,20 +612,24 @@ func createProxyClient(proxyMap map[string]interface{}) *http.Client {
 
 	// 创建自定义 Transport
 	transport := &http.Transport{
+		// ctx 来自检测请求，软截止取消 probeCtx 时经由节点（及前置代理）的拨号随之中止
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			host, port, err := net.SplitHostPort(addr)
+			metadata, err := newMetadata(addr)
 			if err != nil {
 				return nil, err
 			}
-			var u16Port uint16
-			if portNum, err := strconv.ParseUint(port, 10, 16); err == nil {
-				u16Port = uint16(portNum)
+			var conn net.Conn
+			if dialer != nil {
+				conn, err = proxy.DialContextWithDialer(ctx, dialer, metadata)
+			} else {
+				conn, err = proxy.DialContext(ctx, metadata)
 			}
-			return proxy.DialContext(ctx, &constant.Metadata{
-				Host:    host,
-				DstPort: u16Port,
-			})
+			if err != nil {
+				return nil, &dialError{err}
+			}
+			return conn, nil
 		},
+		// 每次检测的请求发往不同地址，读取失败的连接也无法复用，不保留空闲隧道
 		IdleConnTimeout:   3 * time.Second,
 		DisableKeepAlives: true,
 	}
@@ -194,95 +640,371 @@ func createProxyClient(proxyMap map[string]interface{}) *http.Client {
 	}
 }
 
-// getProxyISO 通过代理获取 ISO 国家代码
-func getProxyISO(client *http.Client) (string, error) {
+// probeURL 读取 URL 测试地址 PROBE_URL，默认 generate_204
+func probeURL() string {
+	if url := os.Getenv("PROBE_URL"); url != "" {
+		return url
+	}
+	return "https://www.gstatic.com/generate_204"
+}
+
+// urlTestProxy 使用 mihomo 代理自带的 URL 测试访问 PROBE_URL（默认 generate_204），返回延迟
+func urlTestProxy(probeCtx context.Context, proxyMap map[string]interface{}) (time.Duration, error) {
+	proxy, err := adapter.ParseProxy(proxyMap)
+	if err != nil {
+		return 0, &probeError{kind: probeConnect, msg: err.Error()}
+	}
+	ctx, cancel := context.WithTimeout(probeCtx, 5*time.Second)
+	defer cancel()
+	delay, err := proxy.URLTest(ctx, probeURL(), nil)
+	if err != nil {
+		// URLTest 先经由节点拨号，成功后才发起 HTTP 请求，HTTP 阶段的错误为 *url.Error，视为读取失败
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			return 0, &probeError{kind: probeRead, msg: trimURLError(err)}
+		}
+		return 0, &probeError{kind: probeConnect, msg: err.Error()}
+	}
+	return time.Duration(delay) * time.Millisecond, nil
+}
+
+// validateNodeLine 校验 node.conf 中的一行：能否解析为节点并由 mihomo 构造代理（不拨号）
+func validateNodeLine(line string) error {
+	node, ok := parseNodeLine(line, lineAirport(line))
+	if !ok {
+		return fmt.Errorf("节点行格式错误")
+	}
+	if _, err := adapter.ParseProxy(convertNodeToProxyMap(&node)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// newMetadata 将 host:port 转换为 mihomo 连接元数据
+func newMetadata(addr string) (*constant.Metadata, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var u16Port uint16
+	if portNum, err := strconv.ParseUint(port, 10, 16); err == nil {
+		u16Port = uint16(portNum)
+	}
+	return &constant.Metadata{
+		Host:    host,
+		DstPort: u16Port,
+	}, nil
+}
+
+// probeDialer 返回连接节点使用的拨号器：设置 BIND_ADDR 时从指定源地址拨号，
+// 节点所属机场在 PROBE_FRONT 中配置了前置代理时经由前置代理拨号；均未设置时返回 nil（使用默认拨号）
+func probeDialer(node *Node) constant.Dialer {
+	var outer constant.Dialer
+	if os.Getenv("BIND_ADDR") != "" {
+		outer = &bindDialer{newDialer()}
+	}
+	if front := probeFront(node); front != nil {
+		return &frontDialer{proxy: front, outer: outer}
+	}
+	return outer
+}
+
+// udpBased 判断节点类型是否基于 UDP（前置代理仅支持 TCP，无法经由前置代理检测）
+func udpBased(typ string) bool {
+	switch typ {
+	case "hysteria", "hysteria2", "tuic", "tuic-v5", "wireguard":
+		return true
+	}
+	return false
+}
+
+var (
+	frontMu   sync.Mutex
+	frontSpec string                    // 已解析的 PROBE_FRONT
+	fronts    map[string]constant.Proxy // 机场名 -> 前置代理
+)
+
+// probeFront 返回节点检测使用的前置代理：仅限节点所属机场在 PROBE_FRONT 中配置的前置代理，
+// 基于 UDP 的节点不经由前置代理，直接检测
+func probeFront(node *Node) constant.Proxy {
+	front := probeFronts()[node.Source]
+	if front != nil && udpBased(node.Type) {
+		Debug("EGRESS", "[%s] %s: %s 节点不经由前置代理，直接检测", node.Source, node.OriginName, node.Type)
+		return nil
+	}
+	return front
+}
+
+// probeFronts 解析 PROBE_FRONT 中各机场的前置代理，配置不变时复用上次的解析结果
+func probeFronts() map[string]constant.Proxy {
+	spec := os.Getenv("PROBE_FRONT")
+	frontMu.Lock()
+	defer frontMu.Unlock()
+	if fronts != nil && spec == frontSpec {
+		return fronts
+	}
+	frontSpec, fronts = spec, make(map[string]constant.Proxy)
+	for airport, line := range parseProbeFront(spec) {
+		node, ok := parseNodeLine(line, airport)
+		if !ok {
+			Error("EGRESS", "[%s] PROBE_FRONT 格式错误: %s", airport, line)
+			continue
+		}
+		proxy, err := adapter.ParseProxy(convertNodeToProxyMap(&node))
+		if err != nil {
+			Error("EGRESS", "[%s] PROBE_FRONT 创建代理失败: %v", airport, err)
+			continue
+		}
+		Info("EGRESS", "[%s] 出口检测使用前置代理: %s", airport, node.OriginName)
+		fronts[airport] = proxy
+	}
+	return fronts
+}
+
+// 解析 PROBE_FRONT，格式：机场名:前置代理节点行（Surge 格式）||机场名2:节点行，返回 map[机场名]节点行
+// 未指定机场名的条目不会作用于所有节点，记录错误后忽略
+func parseProbeFront(s string) map[string]string {
+	result := make(map[string]string)
+	for _, part := range strings.Split(s, "||") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		airport, line, ok := strings.Cut(part, ":")
+		airport = strings.TrimSpace(airport)
+		if !ok || airport == "" || strings.Contains(airport, "=") {
+			Error("EGRESS", "PROBE_FRONT 缺少机场名，忽略: %s", part)
+			continue
+		}
+		result[airport] = strings.TrimSpace(line)
+	}
+	return result
+}
+
+// frontDialer 通过前置代理连接节点（代理链），outer 非空时前置代理本身也经由 outer 拨号
+type frontDialer struct {
+	proxy constant.Proxy
+	outer constant.Dialer
+}
+
+func (d *frontDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	metadata, err := newMetadata(address)
+	if err != nil {
+		return nil, err
+	}
+	if d.outer != nil {
+		return d.proxy.DialContextWithDialer(ctx, d.outer, metadata)
+	}
+	return d.proxy.DialContext(ctx, metadata)
+}
+
+func (d *frontDialer) ListenPacket(ctx context.Context, network, address string, rAddrPort netip.AddrPort) (net.PacketConn, error) {
+	return nil, fmt.Errorf("前置代理不支持 UDP")
+}
+
+// bindDialer 实现 mihomo 的 Dialer 接口，TCP/UDP 均从 BIND_ADDR 指定的源地址发出
+type bindDialer struct {
+	*net.Dialer
+}
+
+func (d *bindDialer) ListenPacket(ctx context.Context, network, address string, rAddrPort netip.AddrPort) (net.PacketConn, error) {
+	if d.LocalAddr != nil {
+		address = net.JoinHostPort(d.LocalAddr.(*net.TCPAddr).IP.String(), "0")
+	}
+	var lc net.ListenConfig
+	return lc.ListenPacket(ctx, network, address)
+}
+
+// 出口检测失败类型
+const (
+	probeConnect = "connect" // 无法通过节点建立连接（节点不可用），不重试
+	probeRead    = "read"    // 已建立连接但读取超时或中断（节点慢但可能存活），重试
+	probeGeo     = "geo"     // 响应异常或未包含 ISO
+)
+
+// probeError 带分类的出口检测错误
+type probeError struct {
+	kind string
+	msg  string
+}
+
+func (e *probeError) Error() string { return e.msg }
+
+// dialError 标记经由节点拨号阶段产生的错误，用于区分连接失败和读取失败
+type dialError struct {
+	err error
+}
+
+func (e *dialError) Error() string { return e.err.Error() }
+func (e *dialError) Unwrap() error { return e.err }
+
+// probeReadRetries 读取失败时对同一地址的重试次数，PROBE_READ_RETRIES 配置，默认 1
+func probeReadRetries() int {
+	if n, err := strconv.Atoi(os.Getenv("PROBE_READ_RETRIES")); err == nil && n >= 0 {
+		return n
+	}
+	return 1
+}
+
+// getProxyISO 通过代理获取 ISO 国家代码，同时返回成功请求的耗时作为节点延迟
+// 连接失败立即放弃；读取失败按 PROBE_READ_RETRIES 重试同一地址后再尝试下一个地址
+func getProxyISO(probeCtx context.Context, client *http.Client) (string, time.Duration, error) {
 	// 轮询 1.1.1.1 和 1.0.0.1
 	urls := []string{
 		"https://1.1.1.1/cdn-cgi/trace",
 		"https://1.0.0.1/cdn-cgi/trace",
 	}
 
-	var errors []string
+	var errMsgs []string
 	errorSet := make(map[string]bool)
+	addError := func(msg string) {
+		if !errorSet[msg] {
+			errMsgs = append(errMsgs, msg)
+			errorSet[msg] = true
+		}
+	}
+	kind := probeGeo
+	retries := probeReadRetries()
 	for _, url := range urls {
-		// 访问 Cloudflare trace 接口
-		resp, err := client.Get(url)
-		if err != nil {
-			// 提取错误信息，去掉URL部分
-			errStr := err.Error()
-			if strings.Contains(errStr, "Get \"") {
-				// 去掉 "Get "https://xxx": " 部分
-				if idx := strings.Index(errStr, ": "); idx != -1 {
-					errStr = errStr[idx+2:]
-				}
+		for attempt := 0; attempt <= retries; attempt++ {
+			if probeCtx.Err() != nil {
+				// 检测已被取消（超过软截止时间），不再重试
+				return "", 0, &probeError{kind: probeRead, msg: probeCtx.Err().Error()}
 			}
-			if !errorSet[errStr] {
-				errors = append(errors, errStr)
-				errorSet[errStr] = true
+			iso, latency, err := traceISO(probeCtx, client, url)
+			if err == nil {
+				return iso, latency, nil
 			}
-			continue // 尝试下一个地址
-		}
-		defer resp.Body.Close()
-
-		// 检查 HTTP 状态码
-		if resp.StatusCode != 200 {
-			errorMsg := fmt.Sprintf("HTTP %d", resp.StatusCode)
-			if !errorSet[errorMsg] {
-				errors = append(errors, errorMsg)
-				errorSet[errorMsg] = true
+			addError(err.msg)
+			kind = err.kind
+			if err.kind == probeConnect {
+				// 节点无法连接，换地址也无意义
+				return "", 0, &probeError{kind: probeConnect, msg: strings.Join(errMsgs, ", ")}
+			}
+			if err.kind != probeRead {
+				break // 非读取失败不重试同一地址
 			}
-			continue
 		}
+	}
 
-		// 读取响应内容
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			// 提取错误信息，去掉URL部分
-			errStr := err.Error()
-			if strings.Contains(errStr, "Get \"") {
-				// 去掉 "Get "https://xxx": " 部分
-				if idx := strings.Index(errStr, ": "); idx != -1 {
-					errStr = errStr[idx+2:]
-				}
-			}
-			if !errorSet[errStr] {
-				errors = append(errors, errStr)
-				errorSet[errStr] = true
-			}
-			continue // 尝试下一个地址
-		}
-
-		// 解析响应获取 ISO
-		// 响应格式类似：loc=HK
-		content := string(body)
-		lines := strings.Split(content, "\n")
-		for _, line := range lines {
-			if strings.HasPrefix(line, "loc=") {
-				iso := strings.TrimPrefix(line, "loc=")
-				if iso != "" {
-					return iso, nil
-				}
+	// 只有当所有 URL 都失败时才返回错误
+	if len(errMsgs) > 0 {
+		return "", 0, &probeError{kind: kind, msg: strings.Join(errMsgs, ", ")}
+	}
+
+	return "", 0, &probeError{kind: probeGeo, msg: "无法获取 ISO 代码"}
+}
+
+// traceISO 访问单个 trace 地址并解析 ISO
+func traceISO(probeCtx context.Context, client *http.Client, url string) (string, time.Duration, *probeError) {
+	req, err := http.NewRequestWithContext(probeCtx, "GET", url, nil)
+	if err != nil {
+		return "", 0, &probeError{kind: probeGeo, msg: err.Error()}
+	}
+	// 访问 Cloudflare trace 接口
+	start := time.Now()
+	resp, perr := doProbe(client, req)
+	if perr != nil {
+		return "", 0, perr
+	}
+	defer resp.Body.Close()
+
+	// 检查 HTTP 状态码
+	if resp.StatusCode != 200 {
+		return "", 0, &probeError{kind: probeGeo, msg: fmt.Sprintf("HTTP %d", resp.StatusCode)}
+	}
+
+	// 读取响应内容
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, &probeError{kind: probeRead, msg: trimURLError(err)}
+	}
+
+	// 解析响应获取 ISO
+	// 响应格式类似：loc=HK
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, "loc=") {
+			if iso := strings.TrimPrefix(line, "loc="); iso != "" {
+				return iso, time.Since(start), nil
 			}
 		}
+	}
 
-		// 如果响应中没有找到 loc 字段
-		errorMsg := "响应中未找到 ISO 代码"
-		if !errorSet[errorMsg] {
-			errors = append(errors, errorMsg)
-			errorSet[errorMsg] = true
-		}
+	// 如果响应中没有找到 loc 字段
+	return "", 0, &probeError{kind: probeGeo, msg: "响应中未找到 ISO 代码"}
+}
+
+// nodeTestURL 返回节点自带的 test-url，仅接受带主机名的 HTTPS 地址；
+// 未设置、http 或无法解析时返回空字符串，回退到默认的 trace 检测
+func nodeTestURL(params map[string]string) string {
+	u, err := url.Parse(params["test-url"])
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return ""
 	}
+	return u.String()
+}
 
-	// 只有当所有 URL 都失败时才返回错误
-	if len(errors) > 0 {
-		return "", fmt.Errorf("%s", strings.Join(errors, ", "))
+// probeTestURL 通过代理访问节点自带的 test-url 检测可达性，返回延迟
+// test-timeout 为秒数，未设置时沿用客户端默认超时；test-url 由机场提供，响应内容不用于识别出口 ISO
+func probeTestURL(probeCtx context.Context, client *http.Client, testURL, testTimeout string) (time.Duration, error) {
+	c := *client
+	if seconds, err := strconv.ParseFloat(testTimeout, 64); err == nil && seconds > 0 {
+		c.Timeout = time.Duration(seconds * float64(time.Second))
+	}
+	req, err := http.NewRequestWithContext(probeCtx, "GET", testURL, nil)
+	if err != nil {
+		return 0, &probeError{kind: probeGeo, msg: err.Error()}
+	}
+	start := time.Now()
+	resp, perr := doProbe(&c, req)
+	if perr != nil {
+		return 0, perr
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return 0, &probeError{kind: probeGeo, msg: fmt.Sprintf("test-url HTTP %d", resp.StatusCode)}
+	}
+	if _, err := io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024)); err != nil {
+		return 0, &probeError{kind: probeRead, msg: trimURLError(err)}
 	}
+	return time.Since(start), nil
+}
+
+// doProbe 发起检测请求，出错时按是否已取得连接分类（见 classifyRequestError）
+func doProbe(client *http.Client, req *http.Request) (*http.Response, *probeError) {
+	var gotConn atomic.Bool
+	trace := &httptrace.ClientTrace{GotConn: func(httptrace.GotConnInfo) { gotConn.Store(true) }}
+	resp, err := client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		return nil, classifyRequestError(err, gotConn.Load())
+	}
+	return resp, nil
+}
 
-	return "", fmt.Errorf("无法获取 ISO 代码")
+// classifyRequestError 区分请求错误是连接失败还是读取失败：
+// 拨号出错或始终未取得连接（节点不通时拨号常被客户端整体超时打断，错误中不含 dialError）为连接失败，
+// 取得连接后的超时或中断为读取失败
+func classifyRequestError(err error, gotConn bool) *probeError {
+	var de *dialError
+	if errors.As(err, &de) || !gotConn {
+		return &probeError{kind: probeConnect, msg: trimURLError(err)}
+	}
+	return &probeError{kind: probeRead, msg: trimURLError(err)}
 }
 
-// getEmojiByISO 根据 ISO 代码计算 emoji
+// trimURLError 提取错误信息，去掉 "Get "https://xxx": " 部分
+func trimURLError(err error) string {
+	errStr := err.Error()
+	if strings.Contains(errStr, "Get \"") {
+		if idx := strings.Index(errStr, ": "); idx != -1 {
+			errStr = errStr[idx+2:]
+		}
+	}
+	return errStr
+}
+
+// getEmojiByISO 根据 ISO 代码计算 emoji，代码不区分大小写，非法代码返回空字符串
 func getEmojiByISO(iso string) string {
+	iso = strings.ToUpper(iso)
 	// 其他 ISO 代码转换为 emoji
 	// 使用 Unicode 区域指示符符号
 	// 将 ISO 代码转换为对应的 emoji
@@ -303,12 +1025,43 @@ func getEmojiByISO(iso string) string {
 		return emoji
 	}
 
+	// 行政区划代码（如 GB-ENG）：有对应旗帜时使用标签序列，否则回退到国家旗帜
+	if country, subdivision, ok := strings.Cut(iso, "-"); ok {
+		if subdivision == "" || !isAlnum(subdivision) {
+			return ""
+		}
+		if subdivisionFlags[iso] {
+			return calculateSubdivisionEmoji(country, subdivision)
+		}
+		return getEmojiByISO(country)
+	}
+
 	// 如果没有预定义映射，使用 Unicode 计算
 	return calculateEmojiFromISO(iso)
 }
 
-// calculateEmojiFromISO 根据 ISO 代码计算 emoji
+// 具有标准旗帜 emoji 的行政区划（Unicode RGI 标签序列）
+var subdivisionFlags = map[string]bool{
+	"GB-ENG": true, // 英格兰
+	"GB-SCT": true, // 苏格兰
+	"GB-WLS": true, // 威尔士
+}
+
+// calculateSubdivisionEmoji 生成行政区划旗帜的标签序列
+// 格式：黑旗 U+1F3F4 + 小写代码对应的标签字符（U+E0061~U+E007A）+ 结束符 U+E007F
+func calculateSubdivisionEmoji(country, subdivision string) string {
+	runes := []rune{0x1F3F4}
+	for _, c := range strings.ToLower(country + subdivision) {
+		runes = append(runes, 0xE0000+c)
+	}
+	return string(append(runes, 0xE007F))
+}
+
+// calculateEmojiFromISO 根据 ISO 代码计算 emoji，仅接受两位大写字母
 func calculateEmojiFromISO(iso string) string {
+	if len(iso) != 2 || iso[0] < 'A' || iso[0] > 'Z' || iso[1] < 'A' || iso[1] > 'Z' {
+		return ""
+	}
 
 	// Unicode 区域指示符符号范围：U+1F1E6 (A) 到 U+1F1FF (Z)
 	// 将 ISO 代码的两个字母转换为对应的 Unicode 字符
@@ -318,8 +1071,20 @@ func calculateEmojiFromISO(iso string) string {
 	return string([]rune{first, second})
 }
 
+// isAlnum 判断字符串是否只由大写字母和数字组成
+func isAlnum(s string) bool {
+	for _, c := range s {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
 // updateFailedCount 更新失败计数
 func updateFailedCount(airport string, ctx *UpdateContext) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
 	if stat, exists := ctx.AirportStats[airport]; exists {
 		stat.Failed++
 	}
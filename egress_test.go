@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/metacubex/mihomo/constant"
+)
+
+func TestGetEmojiByISO(t *testing.T) {
+	const england = "\U0001F3F4\U000E0067\U000E0062\U000E0065\U000E006E\U000E0067\U000E007F"
+	tests := []struct {
+		iso  string
+		want string
+	}{
+		{"GB-ENG", england},
+		{"gb-eng", england},
+		{"JP", "🇯🇵"},
+		{"us", "🇺🇸"},
+		{"BR", "🇧🇷"},     // 不在预定义映射中，按区域指示符计算
+		{"FR-IDF", "🇫🇷"}, // 无标准旗帜的行政区划回退到国家旗帜
+		{"GB-", ""},
+		{"X1", ""},
+	}
+	for _, tt := range tests {
+		if got := getEmojiByISO(tt.iso); got != tt.want {
+			t.Errorf("getEmojiByISO(%q) = %q, want %q", tt.iso, got, tt.want)
+		}
+	}
+}
+
+func TestNodeTestURL(t *testing.T) {
+	tests := []struct {
+		testURL string
+		want    string
+	}{
+		{"https://www.gstatic.com/generate_204", "https://www.gstatic.com/generate_204"},
+		{"http://www.gstatic.com/generate_204", ""},
+		{"https://", ""},
+		{"https://exa mple.com/", ""},
+		{"www.gstatic.com/generate_204", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := nodeTestURL(map[string]string{"test-url": tt.testURL}); got != tt.want {
+			t.Errorf("nodeTestURL(%q) = %q, want %q", tt.testURL, got, tt.want)
+		}
+	}
+}
+
+func TestProbeTestURL(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/trace":
+			w.Write([]byte("ip=1.2.3.4\nloc=JP\n"))
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/error":
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name        string
+		path        string
+		testTimeout string
+		wantErr     bool
+	}{
+		{"loc in body only checks reachability", "/trace", "", false},
+		{"no body", "/generate_204", "5", false},
+		{"timeout exceeded", "/slow", "0.05", true},
+		{"invalid timeout ignored", "/slow", "abc", false},
+		{"negative timeout ignored", "/slow", "-1", false},
+		{"http error", "/error", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			latency, err := probeTestURL(context.Background(), ts.Client(), ts.URL+tt.path, tt.testTimeout)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && latency <= 0 {
+				t.Errorf("latency = %v", latency)
+			}
+		})
+	}
+}
+
+func TestProbeCanceled(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	// 进行中的请求在 probeCtx 取消后立即返回
+	probeCtx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := probeTestURL(probeCtx, ts.Client(), ts.URL, "10"); err == nil {
+		t.Fatal("取消后 probeTestURL 未返回错误")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("取消后 %v 才返回", elapsed)
+	}
+
+	// 已取消时 getProxyISO 不再发起请求和重试
+	if _, _, err := getProxyISO(probeCtx, ts.Client()); err == nil {
+		t.Error("取消后 getProxyISO 未返回错误")
+	}
+}
+
+func TestProbeTimeoutKind(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	// 拨号一直未完成、被客户端整体超时打断：连接失败
+	stalled := &http.Client{
+		Timeout: 200 * time.Millisecond,
+		Transport: &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}},
+	}
+	if _, _, err := traceISO(context.Background(), stalled, ts.URL); err == nil || err.kind != probeConnect {
+		t.Errorf("拨号超时 err = %v, want kind %q", err, probeConnect)
+	}
+
+	// 已建立连接但迟迟没有响应：读取失败
+	client := ts.Client()
+	client.Timeout = 200 * time.Millisecond
+	if _, _, err := traceISO(context.Background(), client, ts.URL); err == nil || err.kind != probeRead {
+		t.Errorf("读取超时 err = %v, want kind %q", err, probeRead)
+	}
+}
+
+func TestParseProbeFront(t *testing.T) {
+	got := parseProbeFront("机场A:front = ss,1.2.3.4,8388,encrypt-method=aes-128-gcm,password=x|| 机场B : relay = trojan,[2001:db8::1],443,password=y||front = ss,5.6.7.8,8388,password=z")
+	want := map[string]string{
+		"机场A": "front = ss,1.2.3.4,8388,encrypt-method=aes-128-gcm,password=x",
+		"机场B": "relay = trojan,[2001:db8::1],443,password=y",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseProbeFront = %q, want %q", got, want)
+	}
+}
+
+// 仅用于区分拨号器是否经由前置代理
+type fakeProxy struct{ constant.Proxy }
+
+func TestProbeDialerFront(t *testing.T) {
+	t.Setenv("BIND_ADDR", "")
+	t.Setenv("PROBE_FRONT", "A:front = ss,1.2.3.4,8388,encrypt-method=aes-128-gcm,password=x")
+	frontMu.Lock()
+	prevSpec, prevFronts := frontSpec, fronts
+	frontSpec, fronts = os.Getenv("PROBE_FRONT"), map[string]constant.Proxy{"A": fakeProxy{}}
+	frontMu.Unlock()
+	t.Cleanup(func() {
+		frontMu.Lock()
+		frontSpec, fronts = prevSpec, prevFronts
+		frontMu.Unlock()
+	})
+
+	tests := []struct {
+		source, typ string
+		wantFront   bool
+	}{
+		{"A", "ss", true},
+		{"A", "trojan", true},
+		{"A", "hysteria2", false}, // UDP 节点直接检测，不因前置代理不支持 UDP 而被丢弃
+		{"A", "tuic-v5", false},
+		{"A", "wireguard", false},
+		{"B", "ss", false}, // 未配置前置代理的机场不受影响
+	}
+	for _, tt := range tests {
+		node := &Node{Source: tt.source, Type: tt.typ}
+		_, isFront := probeDialer(node).(*frontDialer)
+		if isFront != tt.wantFront {
+			t.Errorf("[%s] %s: 经由前置代理 = %v, want %v", tt.source, tt.typ, isFront, tt.wantFront)
+		}
+	}
+}
+
+func TestEgressSoftDeadline(t *testing.T) {
+	// 检测在取消后仍拖延一段时间才返回，egress 必须等检测协程全部退出后才修改 ctx.Nodes
+	var active atomic.Int32
+	prev := probeNode
+	probeNode = func(probeCtx context.Context, node *Node, ctx *UpdateContext) {
+		active.Add(1)
+		defer active.Add(-1)
+		if node.Server == "1.1.1.1" {
+			node.ISO, node.Emoji = "HK", getEmojiByISO("HK")
+			return
+		}
+		<-probeCtx.Done()
+		time.Sleep(20 * time.Millisecond)
+		node.ISO = "late"
+	}
+	defer func() { probeNode = prev }()
+	t.Setenv("EGRESS_SOFT_DEADLINE", "50ms")
+	t.Setenv("GEO_GRACE", "")
+
+	ctx := &UpdateContext{
+		AirportStats: map[string]*Stat{"A": {}},
+		Retained:     make(map[string]bool),
+		Meta:         make(map[string]*NodeMeta),
+		Dropped:      make(map[string][]DropRecord),
+	}
+	ctx.Nodes = append(ctx.Nodes, testNode("A", "", "1.1.1.1"))
+	for i := 0; i < 20; i++ {
+		ctx.Nodes = append(ctx.Nodes, testNode("A", "", fmt.Sprintf("10.0.0.%d", i)))
+	}
+	egress(ctx)
+
+	if n := active.Load(); n != 0 {
+		t.Errorf("egress 返回时仍有 %d 个检测在运行", n)
+	}
+	if len(ctx.Nodes) != 1 || ctx.Nodes[0].Server != "1.1.1.1" {
+		t.Errorf("存活节点 = %+v", ctx.Nodes)
+	}
+	if s := ctx.AirportStats["A"]; s.Total != 1 || s.Failed != 20 {
+		t.Errorf("统计 = %+v", *s)
+	}
+	for _, r := range ctx.Dropped["A"] {
+		if r.Reason != DropDeadline {
+			t.Errorf("丢弃原因 = %q, want %q", r.Reason, DropDeadline)
+		}
+	}
+}
+
+func TestEgressGeoGraceCounts(t *testing.T) {
+	// 曾经检测成功的节点在宽限期内失败时保留，失败计数、失败类型和丢弃记录随之撤销
+	prev := probeNode
+	probeNode = func(probeCtx context.Context, node *Node, ctx *UpdateContext) {
+		if node.Server == "1.1.1.1" {
+			node.ISO, node.Emoji = "HK", getEmojiByISO("HK")
+			return
+		}
+		updateFailedCount(node.Source, ctx)
+		ctx.dropNode(*node, DropRead)
+	}
+	defer func() { probeNode = prev }()
+	t.Setenv("EGRESS_SOFT_DEADLINE", "")
+	t.Setenv("GEO_GRACE", "2")
+	t.Setenv("FAIL_STREAK", "")
+
+	graced, failed := testNode("A", "", "2.2.2.2"), testNode("A", "", "3.3.3.3")
+	ctx := &UpdateContext{
+		Nodes:        []Node{testNode("A", "", "1.1.1.1"), graced, failed},
+		AirportStats: map[string]*Stat{"A": {}},
+		Retained:     make(map[string]bool),
+		Meta:         map[string]*NodeMeta{stableID(graced): {LastISO: "JP", LastEmoji: getEmojiByISO("JP")}},
+		Dropped:      make(map[string][]DropRecord),
+	}
+	egress(ctx)
+
+	if s := ctx.AirportStats["A"]; s.Total != 2 || s.Failed != 1 || s.ReadFailed != 1 {
+		t.Errorf("统计 = %+v", *s)
+	}
+	if got := ctx.Dropped["A"]; len(got) != 1 || got[0].Server != "3.3.3.3" || got[0].Reason != DropRead {
+		t.Errorf("丢弃记录 = %+v", got)
+	}
+	if len(ctx.Nodes) != 2 || ctx.Nodes[1].ISO != "JP" {
+		t.Errorf("存活节点 = %+v", ctx.Nodes)
+	}
+}
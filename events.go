@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// events.go
+// 更新进度推送：通过 Server-Sent Events 在 /conflux/events 实时推送更新任务的进度，
+// 仪表盘或 curl 可直接观察长时间的更新，无需查看日志文件。
+//
+// 事件类型：
+//   job     任务启动、进入新阶段、阶段计数更新和结束时推送任务快照（同 /conflux/jobs/{id}）
+//   fetch   单个机场拉取完成：airport、ok、lines
+//   resolve DNS 解析进度：done、total
+//   geo     出口检测进度：done、total、passed
+
+// 每个订阅者的事件缓冲，消费过慢时丢弃新事件，不阻塞更新流程
+const eventBuffer = 256
+
+// SSE 保活间隔，避免反代因空闲断开连接
+const eventKeepAlive = 15 * time.Second
+
+// Event 结构体：推送给订阅者的事件
+type Event struct {
+	Type string
+	Data interface{}
+}
+
+var (
+	eventsMu    sync.Mutex
+	subscribers = make(map[chan Event]struct{})
+)
+
+// 订阅事件，返回事件通道和取消订阅函数
+func subscribeEvents() (chan Event, func()) {
+	ch := make(chan Event, eventBuffer)
+	eventsMu.Lock()
+	subscribers[ch] = struct{}{}
+	eventsMu.Unlock()
+	return ch, func() {
+		eventsMu.Lock()
+		delete(subscribers, ch)
+		eventsMu.Unlock()
+	}
+}
+
+// 推送事件给所有订阅者（非阻塞）
+func publishEvent(typ string, data interface{}) {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	for ch := range subscribers {
+		select {
+		case ch <- Event{Type: typ, Data: data}:
+		default:
+		}
+	}
+}
+
+// 推送任务快照（调用方持有 jobsMu）
+func publishJob(job *Job) {
+	publishEvent("job", job.snapshot())
+}
+
+// 处理 /conflux/events：以 text/event-stream 持续推送事件，连接时先推送正在运行的任务
+// EventSource 无法设置请求头，可通过 URL 参数传递 token
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("streaming not supported"))
+		return
+	}
+	ch, cancel := subscribeEvents()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no") // 关闭 nginx 等反代的响应缓冲
+	w.WriteHeader(http.StatusOK)
+
+	jobsMu.Lock()
+	var running *Job
+	if currentJob != nil {
+		snap := currentJob.snapshot()
+		running = &snap
+	}
+	jobsMu.Unlock()
+	if running != nil {
+		writeEvent(w, Event{Type: "job", Data: running})
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(eventKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-ch:
+			writeEvent(w, event)
+			flusher.Flush()
+		case <-ticker.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// 按 SSE 格式写入单个事件，data 为 JSON
+func writeEvent(w http.ResponseWriter, event Event) {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		Warn("HTTP", "事件序列化失败: %v", err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+}
@@ -0,0 +1,997 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// format.go
+// 非 Surge 输出格式：/conflux?format=xxx 将 node.conf 中的节点转换为其他客户端的订阅格式。
+// 节点筛选（iso、type）和参数覆盖（udp、quic、tfo）与 Surge 输出一致，先作用于 node.conf 行再转换。
+
+// outputFormat 结构体：单个输出格式的响应类型和渲染函数
+type outputFormat struct {
+	contentType string
+	render      func(w io.Writer, nodes []Node, rc renderContext) error
+}
+
+// renderContext 结构体：渲染时需要的请求信息
+// query: 合并预设后的查询参数
+// url: 客户端请求的完整地址（托管配置头中使用）
+type renderContext struct {
+	query url.Values
+	url   string
+}
+
+// 支持的输出格式，surge 或未设置 format 时按原样输出 node.conf
+var outputFormats = map[string]outputFormat{
+	"clash":     {"text/yaml; charset=utf-8", renderClash},
+	"singbox":   {"application/json; charset=utf-8", renderSingBox},
+	"quanx":     {"text/plain; charset=utf-8", renderQuanX},
+	"loon":      {"text/plain; charset=utf-8", renderLoon},
+	"base64":    {"text/plain; charset=utf-8", renderBase64},
+	"surfboard": {"text/plain; charset=utf-8", renderSurfboard},
+	"json":      {"application/json; charset=utf-8", renderJSON},
+	"provider":  {"text/yaml; charset=utf-8", renderProvider},
+	"managed":   {"text/plain; charset=utf-8", renderManaged},
+}
+
+// User-Agent 关键字（小写）与输出格式的对应关系，按顺序匹配
+// Stash、Clash Verge 等基于 Clash 内核的客户端 UA 中带有 clash 或 mihomo
+var userAgentFormats = []struct{ keyword, format string }{
+	{"shadowrocket", "base64"},
+	{"quantumult", "quanx"},
+	{"loon", "loon"},
+	{"surfboard", "surfboard"},
+	{"surge", "surge"},
+	{"sing-box", "singbox"},
+	{"sfi/", "singbox"},
+	{"sfa/", "singbox"},
+	{"sfm/", "singbox"},
+	{"stash", "clash"},
+	{"clash", "clash"},
+	{"mihomo", "clash"},
+}
+
+// 按 User-Agent 识别客户端对应的输出格式，无法识别时返回空
+func detectFormat(ua string) string {
+	ua = strings.ToLower(ua)
+	for _, f := range userAgentFormats {
+		if strings.Contains(ua, f.keyword) {
+			return f.format
+		}
+	}
+	return ""
+}
+
+// 按查询参数筛选并处理 node.conf 中的节点行，解析为 Node 供其他格式渲染
+func loadOutputNodes(src io.Reader, params url.Values) ([]Node, error) {
+	var nodes []Node
+	scanner := newLineScanner(src)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || !matchFilter(line, params) {
+			continue
+		}
+		node, ok := parseNodeLine(processNode(line, params), lineAirport(line))
+		if !ok {
+			continue
+		}
+		node.Name = node.OriginName
+		node.ISO = lineISO(line)
+		node.Emoji = getEmojiByISO(node.ISO)
+		nodes = append(nodes, node)
+	}
+	return nodes, scanner.Err()
+}
+
+// 将节点转换为 Clash（mihomo）代理配置
+func clashProxy(node *Node) map[string]interface{} {
+	proxy := convertNodeToProxyMap(node)
+	if port, err := strconv.Atoi(node.Port); err == nil {
+		proxy["port"] = port
+	}
+	// Clash 的 vmess 必须指定加密方式，Surge 行中没有对应参数
+	if node.Type == "vmess" {
+		if _, ok := proxy["cipher"]; !ok {
+			proxy["cipher"] = "auto"
+		}
+	}
+	return proxy
+}
+
+// 将节点转换为 Clash proxies 列表
+func clashProxies(nodes []Node) []map[string]interface{} {
+	proxies := make([]map[string]interface{}, 0, len(nodes))
+	for i := range nodes {
+		proxies = append(proxies, clashProxy(&nodes[i]))
+	}
+	return proxies
+}
+
+// 输出 YAML 文档
+func writeYAML(w io.Writer, doc interface{}) error {
+	data, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// 输出 Clash proxies 文档
+// groups=1 时附带自动生成的 proxy-groups，存在规则模板时同时附带 rules
+func renderClash(w io.Writer, nodes []Node, rc renderContext) error {
+	doc := map[string]interface{}{"proxies": clashProxies(nodes)}
+	if rc.query.Get("groups") == "1" {
+		var groups []map[string]interface{}
+		generated := buildGroups(nodes, rc.query)
+		for _, g := range generated {
+			groups = append(groups, clashGroup(g))
+		}
+		doc["proxy-groups"] = groups
+		if rules := renderRules(generated); rules != nil {
+			var clashRules []string
+			for _, rule := range rules {
+				if rule == "" || strings.HasPrefix(rule, "#") {
+					continue
+				}
+				// Surge 的 FINAL 在 Clash 中为 MATCH
+				if policy, ok := strings.CutPrefix(rule, "FINAL,"); ok {
+					rule = "MATCH," + policy
+				}
+				clashRules = append(clashRules, rule)
+			}
+			doc["rules"] = clashRules
+		}
+	}
+	return writeYAML(w, doc)
+}
+
+// 输出 Clash proxy-providers 文档：proxies 之外附带 health-check 段，
+// 可直接复制到引用该 provider 的配置中（使用 PROBE_URL 作为测试地址）
+func renderProvider(w io.Writer, nodes []Node, _ renderContext) error {
+	return writeYAML(w, map[string]interface{}{
+		"proxies": clashProxies(nodes),
+		"health-check": map[string]interface{}{
+			"enable":   true,
+			"url":      probeURL(),
+			"interval": 300,
+		},
+	})
+}
+
+// 判断节点的布尔参数是否开启
+func paramTrue(node *Node, key string) bool {
+	v := node.Params[key]
+	return v == "true" || v == "1"
+}
+
+// 将节点转换为 sing-box outbound；shadow-tls 节点额外返回一个 shadowtls outbound 作为前置
+// sing-box 不支持的类型（snell、TUIC v4、socks5-tls）返回 nil
+func singBoxOutbounds(node *Node) []map[string]interface{} {
+	port, _ := strconv.Atoi(node.Port)
+	out := map[string]interface{}{"tag": node.Name, "server": node.Server, "server_port": port}
+	p := node.Params
+	tls := paramTrue(node, "tls")
+	switch node.Type {
+	case "ss":
+		out["type"] = "shadowsocks"
+		out["method"] = p["encrypt-method"]
+		out["password"] = p["password"]
+		if mode := p["obfs"]; mode != "" {
+			opts := "obfs=" + mode
+			if host := p["obfs-host"]; host != "" {
+				opts += ";obfs-host=" + host
+			}
+			out["plugin"] = "obfs-local"
+			out["plugin_opts"] = opts
+		}
+	case "vmess":
+		out["type"] = "vmess"
+		out["uuid"] = p["username"]
+		out["security"] = "auto"
+		if !paramTrue(node, "vmess-aead") {
+			out["alter_id"] = 1
+		}
+	case "vless":
+		out["type"] = "vless"
+		out["uuid"] = p["username"]
+		if flow := p["flow"]; flow != "" {
+			out["flow"] = flow
+		}
+		tls = tls || p["reality-public-key"] != ""
+	case "trojan":
+		out["type"] = "trojan"
+		out["password"] = p["password"]
+		tls = true
+	case "hysteria2":
+		out["type"] = "hysteria2"
+		out["password"] = p["password"]
+		if pw := p["salamander-password"]; pw != "" {
+			out["obfs"] = map[string]interface{}{"type": "salamander", "password": pw}
+		}
+		// Surge 端口跳跃为 5000-6000;7000，sing-box 为 ["5000:6000", "7000:7000"]
+		if ports := strings.Trim(p["port-hopping"], `"`); ports != "" {
+			var ranges []string
+			for _, r := range strings.Split(ports, ";") {
+				from, to, ok := strings.Cut(strings.TrimSpace(r), "-")
+				if !ok {
+					to = from
+				}
+				ranges = append(ranges, from+":"+to)
+			}
+			out["server_ports"] = ranges
+		}
+		if down, err := strconv.Atoi(p["download-bandwidth"]); err == nil {
+			out["down_mbps"] = down
+		}
+		tls = true
+	case "tuic-v5", "tuic":
+		if p["uuid"] == "" {
+			return nil // sing-box 仅支持 TUIC v5
+		}
+		out["type"] = "tuic"
+		out["uuid"] = p["uuid"]
+		out["password"] = p["password"]
+		if cc := p["congestion-controller"]; cc != "" {
+			out["congestion_control"] = cc
+		}
+		tls = true
+	case "http", "https":
+		out["type"] = "http"
+		tls = node.Type == "https"
+	case "socks5":
+		out["type"] = "socks"
+		out["version"] = "5"
+	case "wireguard":
+		out["type"] = "wireguard"
+		var addrs []string
+		if ip := p["self-ip"]; ip != "" {
+			addrs = append(addrs, ip+"/32")
+		}
+		if ip := p["self-ip-v6"]; ip != "" {
+			addrs = append(addrs, ip+"/128")
+		}
+		out["local_address"] = addrs
+		out["private_key"] = p["private-key"]
+		out["peer_public_key"] = p["public-key"]
+		if psk := p["preshared-key"]; psk != "" {
+			out["pre_shared_key"] = psk
+		}
+		if mtu, err := strconv.Atoi(p["mtu"]); err == nil {
+			out["mtu"] = mtu
+		}
+	default:
+		return nil
+	}
+	if node.Type == "http" || node.Type == "https" || node.Type == "socks5" {
+		if user := p["username"]; user != "" {
+			out["username"] = user
+			out["password"] = p["password"]
+		}
+	}
+
+	if paramTrue(node, "ws") {
+		transport := map[string]interface{}{"type": "ws"}
+		if path := p["ws-path"]; path != "" {
+			transport["path"] = path
+		}
+		if k, v, ok := strings.Cut(p["ws-headers"], ":"); ok {
+			transport["headers"] = map[string]string{strings.TrimSpace(k): strings.TrimSpace(v)}
+		}
+		out["transport"] = transport
+	}
+	if tls {
+		tlsOpts := map[string]interface{}{"enabled": true}
+		if sni := p["sni"]; sni != "" {
+			tlsOpts["server_name"] = sni
+		}
+		if paramTrue(node, "skip-cert-verify") {
+			tlsOpts["insecure"] = true
+		}
+		if alpn := p["alpn"]; alpn != "" {
+			tlsOpts["alpn"] = strings.Split(alpn, ";")
+		}
+		if pbk := p["reality-public-key"]; pbk != "" {
+			tlsOpts["reality"] = map[string]interface{}{"enabled": true, "public_key": pbk, "short_id": p["reality-short-id"]}
+		}
+		if fp := p["client-fingerprint"]; fp != "" {
+			tlsOpts["utls"] = map[string]interface{}{"enabled": true, "fingerprint": fp}
+		}
+		out["tls"] = tlsOpts
+	}
+
+	if pw := p["shadow-tls-password"]; node.Type == "ss" && pw != "" {
+		version, err := strconv.Atoi(p["shadow-tls-version"])
+		if err != nil {
+			version = 3
+		}
+		shadowTLS := map[string]interface{}{
+			"type":        "shadowtls",
+			"tag":         node.Name + " shadow-tls",
+			"server":      node.Server,
+			"server_port": port,
+			"version":     version,
+			"password":    pw,
+			"tls":         map[string]interface{}{"enabled": true, "server_name": p["shadow-tls-sni"]},
+		}
+		out["detour"] = shadowTLS["tag"]
+		return []map[string]interface{}{out, shadowTLS}
+	}
+	return []map[string]interface{}{out}
+}
+
+// 输出 sing-box outbounds：节点之后按地区生成 selector，最后是汇总所有地区的 proxy selector
+// 没有地区的节点直接加入 proxy
+func renderSingBox(w io.Writer, nodes []Node, _ renderContext) error {
+	outbounds := []map[string]interface{}{}
+	groups := map[string][]string{}
+	var isos, ungrouped []string
+	for i := range nodes {
+		node := &nodes[i]
+		outs := singBoxOutbounds(node)
+		if outs == nil {
+			continue
+		}
+		outbounds = append(outbounds, outs...)
+		if node.ISO == "" {
+			ungrouped = append(ungrouped, node.Name)
+			continue
+		}
+		if _, ok := groups[node.ISO]; !ok {
+			isos = append(isos, node.ISO)
+		}
+		groups[node.ISO] = append(groups[node.ISO], node.Name)
+	}
+
+	var proxy []string
+	for _, iso := range isos {
+		tag := regionGroupName(iso)
+		outbounds = append(outbounds, map[string]interface{}{"type": "selector", "tag": tag, "outbounds": groups[iso]})
+		proxy = append(proxy, tag)
+	}
+	proxy = append(proxy, ungrouped...)
+	if len(proxy) > 0 {
+		outbounds = append(outbounds, map[string]interface{}{"type": "selector", "tag": "proxy", "outbounds": proxy})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]interface{}{"outbounds": outbounds})
+}
+
+// 将节点转换为 Quantumult X server_local 行，不支持的类型返回 false
+func quanXLine(node *Node) (string, bool) {
+	p := node.Params
+	var fields []string
+	add := func(k, v string) {
+		if v != "" {
+			fields = append(fields, k+"="+v)
+		}
+	}
+	addr := node.Server + ":" + node.Port
+	if strings.Contains(node.Server, ":") {
+		addr = "[" + node.Server + "]:" + node.Port
+	}
+	tls := usesTLS(node)
+	switch node.Type {
+	case "ss":
+		fields = append(fields, "shadowsocks="+addr)
+		add("method", p["encrypt-method"])
+		add("password", p["password"])
+		add("obfs", p["obfs"])
+		add("obfs-host", p["obfs-host"])
+	case "vmess", "vless":
+		fields = append(fields, node.Type+"="+addr)
+		if node.Type == "vmess" {
+			add("method", "chacha20-poly1305")
+		} else {
+			add("method", "none")
+		}
+		add("password", p["username"])
+		if node.Type == "vmess" && !paramTrue(node, "vmess-aead") {
+			add("aead", "false")
+		}
+		add("vless-flow", p["flow"])
+		add("reality-base64-pubkey", p["reality-public-key"])
+		add("reality-hex-shortid", p["reality-short-id"])
+		tls = tls || p["reality-public-key"] != ""
+	case "trojan":
+		fields = append(fields, "trojan="+addr)
+		add("password", p["password"])
+	case "http", "https":
+		fields = append(fields, "http="+addr)
+		add("username", p["username"])
+		add("password", p["password"])
+	case "socks5", "socks5-tls":
+		fields = append(fields, "socks5="+addr)
+		add("username", p["username"])
+		add("password", p["password"])
+		tls = node.Type == "socks5-tls"
+	default:
+		return "", false
+	}
+
+	// 传输层：ws 用 obfs=ws/wss 表示，否则 TLS 用 obfs=over-tls（ss/vmess/vless）或 over-tls=true（其他类型）
+	switch {
+	case paramTrue(node, "ws"):
+		if tls {
+			add("obfs", "wss")
+		} else {
+			add("obfs", "ws")
+		}
+		if k, v, ok := strings.Cut(p["ws-headers"], ":"); ok && strings.EqualFold(strings.TrimSpace(k), "Host") {
+			add("obfs-host", strings.TrimSpace(v))
+		}
+		add("obfs-uri", p["ws-path"])
+	case tls && (node.Type == "vmess" || node.Type == "vless"):
+		add("obfs", "over-tls")
+	case tls:
+		add("over-tls", "true")
+	}
+	if tls {
+		add("tls-host", p["sni"])
+		if paramTrue(node, "skip-cert-verify") {
+			add("tls-verification", "false")
+		}
+	}
+	if v := p["tfo"]; v != "" {
+		add("fast-open", strconv.FormatBool(paramTrue(node, "tfo")))
+	}
+	if v := p["udp-relay"]; v != "" {
+		add("udp-relay", strconv.FormatBool(paramTrue(node, "udp-relay")))
+	}
+	add("tag", node.Name)
+	return strings.Join(fields, ", "), true
+}
+
+// 输出 Quantumult X server_local 节点列表，每行一个节点
+func renderQuanX(w io.Writer, nodes []Node, _ renderContext) error {
+	var lines []string
+	for i := range nodes {
+		if line, ok := quanXLine(&nodes[i]); ok {
+			lines = append(lines, line)
+		}
+	}
+	_, err := io.WriteString(w, strings.Join(lines, "\n"))
+	return err
+}
+
+// 将节点转换为 Loon 代理行，不支持的类型返回 false
+// Loon 的认证字段按位置给出（密码加引号），ws/TLS/udp 等参数名与 Surge 不同
+func loonLine(node *Node) (string, bool) {
+	p := node.Params
+	quote := func(v string) string { return `"` + v + `"` }
+	fields := []string{node.Server, node.Port}
+	opt := func(k, v string) {
+		if v != "" {
+			fields = append(fields, k+"="+v)
+		}
+	}
+	tls := usesTLS(node)
+	var typ string
+	switch node.Type {
+	case "ss":
+		typ = "Shadowsocks"
+		fields = append(fields, p["encrypt-method"], quote(p["password"]))
+		opt("obfs-name", p["obfs"])
+		opt("obfs-host", p["obfs-host"])
+	case "vmess":
+		typ = "vmess"
+		fields = append(fields, "auto", quote(p["username"]))
+		if paramTrue(node, "vmess-aead") {
+			opt("alterId", "0")
+		} else {
+			opt("alterId", "1")
+		}
+	case "vless":
+		typ = "VLESS"
+		fields = append(fields, quote(p["username"]))
+		opt("flow", p["flow"])
+		opt("public-key", p["reality-public-key"])
+		opt("short-id", p["reality-short-id"])
+		tls = tls || p["reality-public-key"] != ""
+	case "trojan":
+		typ = "trojan"
+		fields = append(fields, quote(p["password"]))
+	case "hysteria2":
+		typ = "Hysteria2"
+		fields = append(fields, quote(p["password"]))
+		opt("salamander-password", p["salamander-password"])
+		opt("download-bandwidth", p["download-bandwidth"])
+	case "http", "https", "socks5", "socks5-tls":
+		typ = strings.TrimSuffix(node.Type, "-tls")
+		if p["username"] != "" {
+			fields = append(fields, p["username"], quote(p["password"]))
+		}
+		if node.Type == "socks5-tls" {
+			opt("over-tls", "true")
+		}
+	default:
+		return "", false
+	}
+
+	if paramTrue(node, "ws") {
+		opt("transport", "ws")
+		opt("path", p["ws-path"])
+		if k, v, ok := strings.Cut(p["ws-headers"], ":"); ok && strings.EqualFold(strings.TrimSpace(k), "Host") {
+			opt("host", strings.TrimSpace(v))
+		}
+	}
+	if tls || node.Type == "hysteria2" {
+		if node.Type == "vmess" || node.Type == "vless" {
+			opt("over-tls", "true")
+		}
+		opt("tls-name", p["sni"])
+		if paramTrue(node, "skip-cert-verify") {
+			opt("skip-cert-verify", "true")
+		}
+	}
+	if p["tfo"] != "" {
+		opt("fast-open", strconv.FormatBool(paramTrue(node, "tfo")))
+	}
+	if p["udp-relay"] != "" {
+		opt("udp", strconv.FormatBool(paramTrue(node, "udp-relay")))
+	}
+	return fmt.Sprintf("%s = %s,%s", node.Name, typ, strings.Join(fields, ",")), true
+}
+
+// 输出 Loon [Proxy] 节点列表，每行一个节点
+func renderLoon(w io.Writer, nodes []Node, _ renderContext) error {
+	var lines []string
+	for i := range nodes {
+		if line, ok := loonLine(&nodes[i]); ok {
+			lines = append(lines, line)
+		}
+	}
+	_, err := io.WriteString(w, strings.Join(lines, "\n"))
+	return err
+}
+
+// 将节点转换为分享链接（ss/vmess/trojan/vless/hysteria2/tuic），格式与订阅解析支持的链接一致
+// 不支持的类型返回 false
+func shareURI(node *Node) (string, bool) {
+	p := node.Params
+	host := node.Server + ":" + node.Port
+	if strings.Contains(node.Server, ":") {
+		host = "[" + node.Server + "]:" + node.Port
+	}
+	q := url.Values{}
+	// ws 传输参数（trojan/vless 共用）
+	transport := func() {
+		if paramTrue(node, "ws") {
+			q.Set("type", "ws")
+			if path := p["ws-path"]; path != "" {
+				q.Set("path", path)
+			}
+			if k, v, ok := strings.Cut(p["ws-headers"], ":"); ok && strings.EqualFold(strings.TrimSpace(k), "Host") {
+				q.Set("host", strings.TrimSpace(v))
+			}
+		}
+	}
+	build := func(scheme string, user *url.Userinfo) string {
+		u := url.URL{Scheme: scheme, User: user, Host: host, RawQuery: q.Encode(), Fragment: node.Name}
+		return u.String()
+	}
+
+	switch node.Type {
+	case "ss":
+		userinfo := base64.RawURLEncoding.EncodeToString([]byte(p["encrypt-method"] + ":" + p["password"]))
+		if mode := p["obfs"]; mode != "" {
+			plugin := "obfs-local;obfs=" + mode
+			if obfsHost := p["obfs-host"]; obfsHost != "" {
+				plugin += ";obfs-host=" + obfsHost
+			}
+			q.Set("plugin", plugin)
+		}
+		return build("ss", url.User(userinfo)), true
+	case "vmess":
+		link := vmessLink{V: "2", PS: node.Name, Add: node.Server, Port: node.Port, ID: p["username"], Aid: "0", Net: "tcp", Scy: "auto"}
+		if !paramTrue(node, "vmess-aead") {
+			link.Aid = "1"
+		}
+		if paramTrue(node, "ws") {
+			link.Net = "ws"
+			link.Path = p["ws-path"]
+			if k, v, ok := strings.Cut(p["ws-headers"], ":"); ok && strings.EqualFold(strings.TrimSpace(k), "Host") {
+				link.Host = strings.TrimSpace(v)
+			}
+		}
+		if paramTrue(node, "tls") {
+			link.TLS = "tls"
+			link.SNI = p["sni"]
+		}
+		data, err := json.Marshal(link)
+		if err != nil {
+			return "", false
+		}
+		return "vmess://" + base64.StdEncoding.EncodeToString(data), true
+	case "trojan":
+		transport()
+		if sni := p["sni"]; sni != "" {
+			q.Set("sni", sni)
+		}
+		if paramTrue(node, "skip-cert-verify") {
+			q.Set("allowInsecure", "1")
+		}
+		return build("trojan", url.User(p["password"])), true
+	case "vless":
+		transport()
+		q.Set("encryption", "none")
+		switch {
+		case p["reality-public-key"] != "":
+			q.Set("security", "reality")
+			q.Set("pbk", p["reality-public-key"])
+			if sid := p["reality-short-id"]; sid != "" {
+				q.Set("sid", sid)
+			}
+		case paramTrue(node, "tls"):
+			q.Set("security", "tls")
+		}
+		if sni := p["sni"]; sni != "" {
+			q.Set("sni", sni)
+		}
+		if fp := p["client-fingerprint"]; fp != "" {
+			q.Set("fp", fp)
+		}
+		if flow := p["flow"]; flow != "" {
+			q.Set("flow", flow)
+		}
+		return build("vless", url.User(p["username"])), true
+	case "hysteria2":
+		if sni := p["sni"]; sni != "" {
+			q.Set("sni", sni)
+		}
+		if paramTrue(node, "skip-cert-verify") {
+			q.Set("insecure", "1")
+		}
+		if pw := p["salamander-password"]; pw != "" {
+			q.Set("obfs", "salamander")
+			q.Set("obfs-password", pw)
+		}
+		return build("hysteria2", url.User(p["password"])), true
+	case "tuic-v5", "tuic":
+		if p["uuid"] == "" {
+			return "", false // 分享链接仅支持 TUIC v5
+		}
+		if sni := p["sni"]; sni != "" {
+			q.Set("sni", sni)
+		}
+		if alpn := p["alpn"]; alpn != "" {
+			q.Set("alpn", strings.ReplaceAll(alpn, ";", ","))
+		}
+		if paramTrue(node, "skip-cert-verify") {
+			q.Set("allow_insecure", "1")
+		}
+		if cc := p["congestion-controller"]; cc != "" {
+			q.Set("congestion_control", cc)
+		}
+		return build("tuic", url.UserPassword(p["uuid"], p["password"])), true
+	}
+	return "", false
+}
+
+// 输出 base64 编码的分享链接列表（Shadowrocket 等客户端的通用订阅格式）
+func renderBase64(w io.Writer, nodes []Node, _ renderContext) error {
+	var uris []string
+	for i := range nodes {
+		if uri, ok := shareURI(&nodes[i]); ok {
+			uris = append(uris, uri)
+		}
+	}
+	_, err := io.WriteString(w, base64.StdEncoding.EncodeToString([]byte(strings.Join(uris, "\n"))))
+	return err
+}
+
+// Surfboard 支持的节点类型
+var surfboardTypes = map[string]bool{
+	"ss": true, "vmess": true, "trojan": true, "http": true, "https": true,
+	"socks5": true, "socks5-tls": true, "wireguard": true,
+}
+
+// Surfboard 不识别的 Surge 参数，带上这些参数时整份配置会被拒绝
+var surfboardIgnoredParams = map[string]bool{
+	"block-quic": true, "tfo": true, "ecn": true, "client-fingerprint": true,
+	"congestion-controller": true, "underlying-proxy": true, "ip-version": true,
+	"test-url": true, "test-timeout": true, "server-cert-fingerprint-sha256": true, "tested": true,
+}
+
+// 输出 Surfboard 代理行：Surge 语法，去掉 Surfboard 不支持的类型和参数
+// shadow-tls 节点去掉插件参数后无法连接，整行跳过
+func renderSurfboard(w io.Writer, nodes []Node, _ renderContext) error {
+	nodes = filterNodes(nodes, func(n *Node) bool {
+		return surfboardTypes[n.Type] && n.Params["shadow-tls-password"] == ""
+	})
+	lines, sections := surgeLines(nodes, surfboardIgnoredParams)
+	_, err := io.WriteString(w, joinSurgeLines(lines, sections))
+	return err
+}
+
+// 保留 keep 返回 true 的节点
+func filterNodes(nodes []Node, keep func(*Node) bool) []Node {
+	var kept []Node
+	for i := range nodes {
+		if keep(&nodes[i]) {
+			kept = append(kept, nodes[i])
+		}
+	}
+	return kept
+}
+
+// 将节点还原为 Surge 语法的代理行，移除 ignored 中的参数
+// WireGuard 节点输出 section-name 引用，对应的 [WireGuard] 段单独返回
+func surgeLines(nodes []Node, ignored map[string]bool) ([]string, []string) {
+	var lines, sections []string
+	for i := range nodes {
+		node := &nodes[i]
+		var params []string
+		for _, p := range strings.Split(node.ParamString, ",") {
+			if k, _, ok := strings.Cut(p, "="); ok && !ignored[k] {
+				params = append(params, p)
+			}
+		}
+		line := fmt.Sprintf("%s = %s,%s,%s, %s", node.Name, node.Type, node.Server, node.Port, strings.Join(params, ","))
+		if proxy, section, ok := renderWireGuard(line, fmt.Sprintf("wg-%02d", len(sections)+1)); ok {
+			line = proxy
+			sections = append(sections, section)
+		}
+		lines = append(lines, line)
+	}
+	return lines, sections
+}
+
+// 代理行之后追加 [WireGuard] 段
+func joinSurgeLines(lines, sections []string) string {
+	out := strings.Join(lines, "\n")
+	for _, section := range sections {
+		out += "\n\n" + section
+	}
+	return out
+}
+
+// jsonNode 结构体：format=json 输出的单个节点
+type jsonNode struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type"`
+	Server string            `json:"server"`
+	Port   string            `json:"port"`
+	ISO    string            `json:"iso"`
+	Emoji  string            `json:"emoji"`
+	Source string            `json:"source"`
+	Params map[string]string `json:"params"`
+}
+
+// 输出结构化节点列表 JSON
+func renderJSON(w io.Writer, nodes []Node, _ renderContext) error {
+	result := make([]jsonNode, 0, len(nodes))
+	for _, n := range nodes {
+		result = append(result, jsonNode{n.Name, n.Type, n.Server, n.Port, n.ISO, n.Emoji, n.Source, n.Params})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
+
+// Surge 托管配置模板路径，{{proxies}} 替换为代理行，{{proxy-names}} 替换为逗号分隔的节点名，
+// {{groups}} 替换为自动生成的策略组，{{rules}} 替换为规则模板渲染结果
+const surgeTemplatePath = "/data/conflux/surge.tpl"
+
+// 未提供模板时使用的默认 Surge 配置
+const defaultSurgeTemplate = `[General]
+loglevel = notify
+dns-server = system
+skip-proxy = 127.0.0.1, 192.168.0.0/16, 10.0.0.0/8, 172.16.0.0/12, localhost, *.local
+
+[Proxy]
+{{proxies}}
+
+[Proxy Group]
+Proxy = select, {{proxy-names}}
+{{groups}}
+
+[Rule]
+{{rules}}
+`
+
+// 未提供规则模板时使用的默认规则
+var defaultRules = []string{"GEOIP,CN,DIRECT", "FINAL,Proxy"}
+
+// 输出完整的 Surge 托管配置：#!MANAGED-CONFIG 头 + 模板，[WireGuard] 段追加在末尾
+// 更新间隔与 UPDATE_INTERVAL 一致
+func renderManaged(w io.Writer, nodes []Node, rc renderContext) error {
+	tpl := defaultSurgeTemplate
+	if data, err := readDataFile(surgeTemplatePath); err == nil {
+		tpl = string(data)
+	}
+	nodes = filterNodes(nodes, func(n *Node) bool { return !surgeUnsupported[n.Type] })
+	lines, sections := surgeLines(nodes, surgeIgnoredParams)
+	names := nodeNames(nodes)
+	if len(names) == 0 {
+		names = []string{"DIRECT"}
+	}
+	var groups []string
+	generated := buildGroups(nodes, rc.query)
+	for _, g := range generated {
+		groups = append(groups, surgeGroupLine(g))
+	}
+	rules := renderRules(generated)
+	if rules == nil {
+		rules = defaultRules
+	}
+
+	conf := strings.NewReplacer(
+		"{{proxies}}", strings.Join(lines, "\n"),
+		"{{proxy-names}}", strings.Join(names, ", "),
+		"{{groups}}", strings.Join(groups, "\n"),
+		"{{rules}}", strings.Join(rules, "\n"),
+	).Replace(tpl)
+	header := fmt.Sprintf("#!MANAGED-CONFIG %s interval=%d strict=false\n\n", rc.url, int(updateInterval().Seconds()))
+	_, err := io.WriteString(w, header+joinSurgeLines([]string{strings.TrimRight(conf, "\n")}, sections)+"\n")
+	return err
+}
+
+// 计算模板文件摘要，模板变化时 /conflux 的 ETag 随之变化
+func templateDigest() string {
+	var b strings.Builder
+	for _, path := range []string{surgeTemplatePath, rulesTemplatePath} {
+		if t, err := dataFileModTime(path); err == nil {
+			fmt.Fprintf(&b, "\n%s@%d", path, t.UnixNano())
+		}
+	}
+	return b.String()
+}
+
+// proxyGroup 结构体：生成的策略组
+// URL / Interval: url-test、fallback、load-balance 组的测试地址和间隔（秒）
+type proxyGroup struct {
+	Name     string
+	Type     string
+	Proxies  []string
+	URL      string
+	Interval int
+}
+
+// 节点名列表
+func nodeNames(nodes []Node) []string {
+	names := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		names = append(names, n.Name)
+	}
+	return names
+}
+
+// 地区策略组名，如 🇭🇰 HK
+func regionGroupName(iso string) string {
+	return strings.TrimSpace(getEmojiByISO(iso) + " " + iso)
+}
+
+// 支持的策略组类型
+var groupTypes = map[string]bool{"select": true, "url-test": true, "fallback": true, "load-balance": true}
+
+// 读取策略组设置：类型 group-type（默认取 GROUP_TYPE，再默认 select）和分组方式 group-by
+// （默认取 GROUP_BY，再默认 region；可选 region、airport，逗号分隔），请求参数优先
+func groupSettings(query url.Values) (string, []string) {
+	typ := firstNonEmpty(query.Get("group-type"), os.Getenv("GROUP_TYPE"), "select")
+	if !groupTypes[typ] {
+		Warn("HTTP", "不支持的策略组类型 %s，使用 select", typ)
+		typ = "select"
+	}
+	by := strings.Split(firstNonEmpty(query.Get("group-by"), os.Getenv("GROUP_BY"), "region"), ",")
+	return typ, by
+}
+
+// 自动测速类策略组的测试地址 GROUP_TEST_URL（默认与 PROBE_URL 相同）和间隔 GROUP_INTERVAL（秒，默认 300）
+func groupTest() (string, int) {
+	interval, err := strconv.Atoi(os.Getenv("GROUP_INTERVAL"))
+	if err != nil || interval <= 0 {
+		interval = 300
+	}
+	return firstNonEmpty(os.Getenv("GROUP_TEST_URL"), probeURL()), interval
+}
+
+// 按地区和/或机场生成策略组（按首次出现顺序），最后是包含全部节点的 All 组（select）
+// 没有地区的节点只出现在 All 组中
+func buildGroups(nodes []Node, query url.Values) []proxyGroup {
+	if len(nodes) == 0 {
+		return nil
+	}
+	typ, by := groupSettings(query)
+	testURL, interval := groupTest()
+	var groups []proxyGroup
+	index := map[string]int{}
+	add := func(name, member string) {
+		i, ok := index[name]
+		if !ok {
+			i = len(groups)
+			index[name] = i
+			g := proxyGroup{Name: name, Type: typ}
+			if typ != "select" {
+				g.URL, g.Interval = testURL, interval
+			}
+			groups = append(groups, g)
+		}
+		groups[i].Proxies = append(groups[i].Proxies, member)
+	}
+	for _, key := range by {
+		for _, n := range nodes {
+			switch strings.TrimSpace(key) {
+			case "region":
+				if n.ISO != "" {
+					add(regionGroupName(n.ISO), n.Name)
+				}
+			case "airport":
+				if n.Source != "" {
+					add(n.Source, n.Name)
+				}
+			}
+		}
+	}
+	return append(groups, proxyGroup{Name: "All", Type: "select", Proxies: nodeNames(nodes)})
+}
+
+// Surge [Proxy Group] 行；Surge 的 load-balance 不使用 interval
+func surgeGroupLine(g proxyGroup) string {
+	line := fmt.Sprintf("%s = %s, %s", g.Name, g.Type, strings.Join(g.Proxies, ", "))
+	if g.URL != "" {
+		line += ", url=" + g.URL
+		if g.Type != "load-balance" {
+			line += fmt.Sprintf(", interval=%d", g.Interval)
+		}
+	}
+	return line
+}
+
+// Clash proxy-groups 条目
+func clashGroup(g proxyGroup) map[string]interface{} {
+	group := map[string]interface{}{"name": g.Name, "type": g.Type, "proxies": g.Proxies}
+	if g.URL != "" {
+		group["url"] = g.URL
+		group["interval"] = g.Interval
+	}
+	return group
+}
+
+// 规则模板路径：每行一条规则（Surge 语法，Clash 输出时去掉空行和 # 注释）
+// {{group:名称}} 替换为对应地区（ISO）或机场的策略组名，该组不存在时使用 All；{{all}} 替换为 All
+const rulesTemplatePath = "/data/conflux/rules.tpl"
+
+var groupPlaceholder = regexp.MustCompile(`\{\{group:([^}]+)\}\}`)
+
+// 渲染规则模板，模板不存在时返回 nil
+func renderRules(groups []proxyGroup) []string {
+	data, err := readDataFile(rulesTemplatePath)
+	if err != nil {
+		return nil
+	}
+	exists := map[string]bool{}
+	for _, g := range groups {
+		exists[g.Name] = true
+	}
+	resolve := func(name string) string {
+		if region := regionGroupName(strings.ToUpper(name)); exists[region] {
+			return region
+		}
+		if exists[name] {
+			return name
+		}
+		return "All"
+	}
+	var rules []string
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		line = groupPlaceholder.ReplaceAllStringFunc(strings.TrimSpace(line), func(m string) string {
+			return resolve(strings.TrimSpace(groupPlaceholder.FindStringSubmatch(m)[1]))
+		})
+		rules = append(rules, strings.ReplaceAll(line, "{{all}}", "All"))
+	}
+	return rules
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// guard.go
+// 访问控制：在路由和 token 校验之前按客户端 IP 过滤请求，对 /conflux 按 IP 限流，
+// 并临时封禁反复提交无效凭据的 IP。
+
+// 客户端 IP：默认取连接地址；经反代（如配套 Worker、CDN）访问时设置 REAL_IP_HEADER，
+// 取该请求头中的第一个地址（仅在反代会覆盖该头时设置，否则可被伪造）
+func clientIP(r *http.Request) netip.Addr {
+	if header := os.Getenv("REAL_IP_HEADER"); header != "" {
+		first, _, _ := strings.Cut(r.Header.Get(header), ",")
+		if addr, err := netip.ParseAddr(strings.TrimSpace(first)); err == nil {
+			return addr.Unmap()
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, _ := netip.ParseAddr(host)
+	return addr.Unmap()
+}
+
+// 解析逗号分隔的 CIDR 列表，单个 IP 视为 /32 或 /128，无法解析的条目忽略并记录
+func parseCIDRs(s string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(item); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(item); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+		} else {
+			Warn("HTTP", "无法解析的 CIDR，忽略: %s", item)
+		}
+	}
+	return prefixes
+}
+
+// 判断地址是否在任一网段内
+func inCIDRs(addr netip.Addr, prefixes []netip.Prefix) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// 判断客户端 IP 是否允许访问：命中 deny 拒绝；allow 非空时必须命中其中之一
+func ipAllowed(addr netip.Addr, allow, deny []netip.Prefix) bool {
+	if inCIDRs(addr, deny) {
+		return false
+	}
+	return len(allow) == 0 || inCIDRs(addr, allow)
+}
+
+// IP 过滤中间件，作用于所有路由；DENY_CIDRS / ALLOW_CIDRS 在启动时解析一次
+// ALLOW_CIDRS 已设置但没有任何可解析的条目时退出，避免因笔误放行所有地址
+func ipFilter(next http.Handler) http.Handler {
+	deny := parseCIDRs(os.Getenv("DENY_CIDRS"))
+	allowEnv := os.Getenv("ALLOW_CIDRS")
+	allow := parseCIDRs(allowEnv)
+	if strings.Trim(allowEnv, " ,") != "" && len(allow) == 0 {
+		Error("HTTP", "ALLOW_CIDRS 中没有可解析的网段: %s", allowEnv)
+		os.Exit(1)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if addr := clientIP(r); !ipAllowed(addr, allow, deny) {
+			Warn("HTTP", "IP 不在允许范围内，拒绝访问: %s %s", addr, r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("forbidden"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tokenBucket 结构体：单个 IP 的令牌桶
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// 令牌桶数量上限，超过时先清理已回满的桶，仍超过则淘汰最久未访问的桶
+const maxBuckets = 10000
+
+var (
+	bucketsMu sync.Mutex
+	buckets   = make(map[netip.Addr]*tokenBucket)
+)
+
+// 读取限流设置：RATE_LIMIT 为每秒补充的请求数（0 或未设置不限流），RATE_BURST 为桶容量（默认 10）
+func rateLimitPolicy() (float64, float64) {
+	rate, err := strconv.ParseFloat(os.Getenv("RATE_LIMIT"), 64)
+	if err != nil || rate <= 0 {
+		return 0, 0
+	}
+	burst, err := strconv.ParseFloat(os.Getenv("RATE_BURST"), 64)
+	if err != nil || burst < 1 {
+		burst = 10
+	}
+	return rate, burst
+}
+
+// 从 IP 的令牌桶中取一个令牌，不足时返回需等待的时间
+func takeToken(addr netip.Addr, rate, burst float64) (bool, time.Duration) {
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+	now := time.Now()
+	b, ok := buckets[addr]
+	if !ok {
+		// 清理已回满的桶，避免扫描器轮换 IP 时无限增长
+		if len(buckets) >= maxBuckets {
+			for k, v := range buckets {
+				if v.tokens+now.Sub(v.last).Seconds()*rate >= burst {
+					delete(buckets, k)
+				}
+			}
+			evictOldestBuckets()
+		}
+		b = &tokenBucket{tokens: burst, last: now}
+		buckets[addr] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// 桶仍未回满（如持续请求的 IP 很多）时按最近访问时间淘汰最旧的桶，
+// 一次淘汰到上限的 90%，避免每个新 IP 都触发一次全表扫描（调用方持有 bucketsMu）
+func evictOldestBuckets() {
+	if len(buckets) < maxBuckets {
+		return
+	}
+	addrs := make([]netip.Addr, 0, len(buckets))
+	for k := range buckets {
+		addrs = append(addrs, k)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return buckets[addrs[i]].last.Before(buckets[addrs[j]].last) })
+	for _, k := range addrs[:len(addrs)-maxBuckets*9/10] {
+		delete(buckets, k)
+	}
+}
+
+// 按客户端 IP 限流的中间件，超出时返回 429
+func rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rate, burst := rateLimitPolicy()
+		if rate > 0 {
+			addr := clientIP(r)
+			if ok, wait := takeToken(addr, rate, burst); !ok {
+				Warn("HTTP", "请求过于频繁，限流: %s", addr)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				w.WriteHeader(http.StatusTooManyRequests)
+				w.Write([]byte("too many requests"))
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// authFailures 结构体：单个 IP 在统计窗口内的鉴权失败记录
+type authFailures struct {
+	times       []time.Time
+	bannedUntil time.Time
+}
+
+var (
+	failuresMu sync.Mutex
+	failures   = make(map[netip.Addr]*authFailures)
+)
+
+// 读取封禁策略：LOCKOUT_THRESHOLD 次失败（默认 10，0 关闭）发生在 LOCKOUT_WINDOW（默认 5m）内时，
+// 封禁该 IP LOCKOUT_DURATION（默认 15m）
+func lockoutPolicy() (int, time.Duration, time.Duration) {
+	threshold := 10
+	if v := os.Getenv("LOCKOUT_THRESHOLD"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			threshold = n
+		}
+	}
+	window, err := time.ParseDuration(os.Getenv("LOCKOUT_WINDOW"))
+	if err != nil || window <= 0 {
+		window = 5 * time.Minute
+	}
+	duration, err := time.ParseDuration(os.Getenv("LOCKOUT_DURATION"))
+	if err != nil || duration <= 0 {
+		duration = 15 * time.Minute
+	}
+	return threshold, window, duration
+}
+
+// 返回 IP 的封禁截止时间，未封禁时返回零值
+func bannedUntil(addr netip.Addr) time.Time {
+	failuresMu.Lock()
+	defer failuresMu.Unlock()
+	if f, ok := failures[addr]; ok && time.Now().Before(f.bannedUntil) {
+		return f.bannedUntil
+	}
+	return time.Time{}
+}
+
+// 记录一次鉴权失败，窗口内达到阈值时封禁
+func recordAuthFailure(addr netip.Addr) {
+	threshold, window, duration := lockoutPolicy()
+	if threshold == 0 {
+		return
+	}
+	failuresMu.Lock()
+	defer failuresMu.Unlock()
+	now := time.Now()
+	f, ok := failures[addr]
+	if !ok {
+		// 清理已过期的记录
+		for k, v := range failures {
+			if now.After(v.bannedUntil) && (len(v.times) == 0 || now.Sub(v.times[len(v.times)-1]) > window) {
+				delete(failures, k)
+			}
+		}
+		f = &authFailures{}
+		failures[addr] = f
+	}
+	recent := f.times[:0]
+	for _, t := range f.times {
+		if now.Sub(t) <= window {
+			recent = append(recent, t)
+		}
+	}
+	f.times = append(recent, now)
+	if len(f.times) >= threshold {
+		f.bannedUntil = now.Add(duration)
+		f.times = nil
+		Warn("HTTP", "IP %s 在 %s 内鉴权失败 %d 次，封禁至 %s", addr, window, threshold, f.bannedUntil.Format("2006-01-02 15:04:05"))
+	}
+}
+
+// 判断请求是否携带了凭据（token、签名或 Basic 认证），未携带凭据的 401 不计入失败次数
+func hasCredentials(r *http.Request) bool {
+	_, _, basic := r.BasicAuth()
+	return requestToken(r) != "" || r.URL.Query().Get("sig") != "" || basic
+}
+
+// statusWriter 记录响应状态码，保留 Flush 以支持流式输出
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// 封禁中间件：拒绝被封禁 IP 的请求，并统计携带凭据但返回 401 的请求
+func lockoutGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := clientIP(r)
+		if until := bannedUntil(addr); !until.IsZero() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(until).Seconds()))))
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("banned"))
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == http.StatusUnauthorized && hasCredentials(r) {
+			recordAuthFailure(addr)
+		}
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestTakeTokenBounded(t *testing.T) {
+	bucketsMu.Lock()
+	prev := buckets
+	buckets = make(map[netip.Addr]*tokenBucket)
+	bucketsMu.Unlock()
+	defer func() {
+		bucketsMu.Lock()
+		buckets = prev
+		bucketsMu.Unlock()
+	}()
+
+	// 轮换 IP 的客户端把每个桶都用空，已回满的桶清理不掉任何条目
+	const rate, burst = 1e-6, 1
+	base := netip.MustParseAddr("10.0.0.0")
+	addr := base
+	for i := 0; i < maxBuckets; i++ {
+		if ok, _ := takeToken(addr, rate, burst); !ok {
+			t.Fatalf("%s 首次请求被限流", addr)
+		}
+		addr = addr.Next()
+	}
+	bucketsMu.Lock()
+	buckets[base].last = time.Now().Add(-time.Hour)
+	bucketsMu.Unlock()
+
+	takeToken(addr, rate, burst)
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+	if n := len(buckets); n > maxBuckets {
+		t.Errorf("令牌桶数量 = %d，超过上限 %d", n, maxBuckets)
+	}
+	if _, ok := buckets[base]; ok {
+		t.Error("最久未访问的桶未被淘汰")
+	}
+	if _, ok := buckets[addr]; !ok {
+		t.Error("新 IP 的桶未创建")
+	}
+}
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+	"unicode"
 )
 
 // ingress.go
@@ -45,42 +54,70 @@ func ingress(ctx *UpdateContext) {
 			newNodes = append(newNodes, node)
 		} else {
 			ctx.AirportStats[node.Source].Duplicated++
+			ctx.dropNode(node, DropDuplicate)
 		}
 	}
 
-	// 处理域名节点（DNS 查询结果）
+	// 处理域名节点（DNS 查询结果），裂变出的节点按机场暂存
+	fissioned := make(map[string][]Node)
+	fixSNI := os.Getenv("FIX_SNI") == "1"
+	family := os.Getenv("FISSION_FAMILY")
 	for _, result := range dnsResults {
 		node := result.node
-		ips := result.ips
+		ips := selectFamily(result.ips, family)
 		stat := ctx.AirportStats[node.Source]
 
 		if len(ips) == 0 {
 			Warn("INGRESS", "DNS 查询失败: [%s] %s", node.Source, node.OriginName)
 			stat.Failed++
+			ctx.dropNode(node, DropDNS)
 			continue
 		}
 
 		// 裂变：一个域名节点变成多个 IP 节点，使用新的 server（IP）进行去重
-		originalServer := node.Server // 保存原始域名用于 SNI 补全
+		fixNodeSNI(&node, node.Server, fixSNI) // 裂变前用原始域名补全 SNI
 		added := false
 		for _, ip := range ips {
 			n := node
 			n.Server = ip // 更新为 IP 地址
-			if needSNI(n.Type) && n.Params["sni"] == "" && isDomain(originalServer) {
-				n.Params["sni"] = originalServer // 使用原始域名作为 SNI
-			}
 			// 使用新的 server（IP）和 port 生成唯一 key
 			key := uniqueKey(n)
 			if _, exists := uniqueSet[key]; !exists {
 				uniqueSet[key] = struct{}{}
-				newNodes = append(newNodes, n)
+				fissioned[n.Source] = append(fissioned[n.Source], n)
 				added = true
 			}
 		}
 		// 如果这个域名节点的所有 IP 都被去重了，则算作被去重
 		if !added {
 			stat.Duplicated++
+			ctx.dropNode(node, DropDuplicate)
+		}
+	}
+
+	// 按机场限制裂变节点总数（AIRPORT_FISSION_CAP），排序后截断保证结果稳定
+	fissionCap, _ := strconv.Atoi(os.Getenv("AIRPORT_FISSION_CAP"))
+	airports := make([]string, 0, len(fissioned))
+	for airport := range fissioned {
+		airports = append(airports, airport)
+	}
+	sort.Strings(airports)
+	for _, airport := range airports {
+		group := fissioned[airport]
+		sort.SliceStable(group, func(i, j int) bool {
+			if group[i].OriginName != group[j].OriginName {
+				return group[i].OriginName < group[j].OriginName
+			}
+			return group[i].Server < group[j].Server
+		})
+		if fissionCap > 0 && len(group) > fissionCap {
+			Warn("INGRESS", "[%s] 裂变节点数 %d 超过上限 %d，截断", airport, len(group), fissionCap)
+			for _, n := range group[fissionCap:] {
+				ctx.dropNode(n, DropCapped)
+			}
+			group = group[:fissionCap]
 		}
+		newNodes = append(newNodes, group...)
 	}
 
 	ctx.Nodes = newNodes
@@ -144,7 +181,9 @@ func concurrentDNSQuery(nodes []Node, concurrency int) []dnsResult {
 	var results []dnsResult
 	for result := range resultChan {
 		results = append(results, result)
+		publishEvent("resolve", map[string]interface{}{"done": len(results), "total": len(nodes)})
 	}
+	dohClient.CloseIdleConnections()
 
 	return results
 }
@@ -154,8 +193,24 @@ func isIP(server string) bool {
 	return net.ParseIP(server) != nil
 }
 
-// 使用普通 DNS 查询 A 记录
+// 查询域名的 A 记录：设置 DOH 时使用 DoH（可选回退系统 DNS），否则使用系统 DNS
+// DNS_HTTPS_RR=1 时先查询 HTTPS 记录（type 65），存在目标域名时改为解析目标域名（类似 CNAME）
 func resolveADNS(domain string) ([]string, error) {
+	// HTTPS 记录只能通过 DoH 查询，未设置 DOH 时跳过，避免绕过系统 DNS 向默认 DoH 服务发出查询
+	if os.Getenv("DNS_HTTPS_RR") == "1" && os.Getenv("DOH") != "" {
+		if target := resolveHTTPSTarget(domain); target != "" {
+			Info("INGRESS", "HTTPS 记录: %s -> %s", domain, target)
+			domain = target
+		}
+	}
+	if os.Getenv("DOH") != "" {
+		ips, err := resolveDoH(domain)
+		// DoH 无应答（如被过滤）但域名可能正常时，DNS_SYSTEM_FALLBACK=1 回退系统 DNS
+		if len(ips) > 0 || os.Getenv("DNS_SYSTEM_FALLBACK") != "1" {
+			return ips, err
+		}
+		Warn("INGRESS", "DoH 无结果，回退系统 DNS: %s", domain)
+	}
 	ips, err := net.LookupHost(domain)
 	if err != nil {
 		return nil, err
@@ -163,10 +218,212 @@ func resolveADNS(domain string) ([]string, error) {
 	return ips, nil
 }
 
+// DNS 记录类型
+const (
+	dnsTypeA     = 1
+	dnsTypeAAAA  = 28
+	dnsTypeHTTPS = 65
+)
+
+// DoH JSON 响应中的单条记录
+type dohAnswer struct {
+	Type int    `json:"type"`
+	Data string `json:"data"`
+}
+
+// 共享的 DoH 客户端：一次更新中的所有查询都发往同一服务器，复用连接避免重复握手
+// 查询结束后关闭空闲连接
+var dohClient = newDoHClient()
+
+// 新建 DoH 客户端，每主机空闲连接数与 DNS 查询并发数一致
+func newDoHClient() *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConnsPerHost = 10
+	return &http.Client{Timeout: 5 * time.Second, Transport: t}
+}
+
+// DoH 服务地址，默认 Cloudflare
+func dohURL() string {
+	if u := os.Getenv("DOH"); u != "" {
+		return u
+	}
+	return "https://1.1.1.1/dns-query"
+}
+
+// 通过 DoH（application/dns-json）查询指定类型记录
+func queryDoH(name string, qtype int) ([]dohAnswer, error) {
+	req, err := http.NewRequest("GET", dohURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Set("name", name)
+	q.Set("type", strconv.Itoa(qtype))
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("Accept", "application/dns-json")
+
+	resp, err := dohClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("DoH HTTP %d", resp.StatusCode)
+	}
+	var result struct {
+		Status int         `json:"Status"`
+		Answer []dohAnswer `json:"Answer"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.Status != 0 {
+		return nil, fmt.Errorf("DoH rcode %d", result.Status)
+	}
+	return result.Answer, nil
+}
+
+// 通过 DoH 查询 A 和 AAAA 记录（忽略应答中的 CNAME 链）
+func resolveDoH(domain string) ([]string, error) {
+	var ips []string
+	var lastErr error
+	for _, qtype := range []int{dnsTypeA, dnsTypeAAAA} {
+		answers, err := queryDoH(domain, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, a := range answers {
+			if a.Type == qtype && isIP(a.Data) {
+				ips = append(ips, a.Data)
+			}
+		}
+	}
+	if len(ips) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return ips, nil
+}
+
+// 查询 HTTPS 记录，返回其中的目标域名；无记录或目标为自身（"."）时返回空
+func resolveHTTPSTarget(domain string) string {
+	answers, err := queryDoH(domain, dnsTypeHTTPS)
+	if err != nil {
+		return ""
+	}
+	for _, a := range answers {
+		if a.Type != dnsTypeHTTPS {
+			continue
+		}
+		if target := parseHTTPSTarget(a.Data); target != "" {
+			return target
+		}
+	}
+	return ""
+}
+
+// 解析 HTTPS 记录的目标域名，兼容两种 DoH 输出：
+// 展示格式 "1 svc.example.com. alpn=h2" 与 RFC 3597 通用格式 "\# 20 00 01 03 73 76 63 ..."
+func parseHTTPSTarget(data string) string {
+	fields := strings.Fields(data)
+	if len(fields) < 2 {
+		return ""
+	}
+	var target string
+	if fields[0] == "\\#" {
+		raw, err := hex.DecodeString(strings.Join(fields[2:], ""))
+		if err != nil || len(raw) < 3 {
+			return ""
+		}
+		// 跳过 2 字节优先级，按 wire 格式读取域名标签
+		var labels []string
+		for i := 2; i < len(raw) && raw[i] != 0; {
+			n := int(raw[i])
+			if i+1+n > len(raw) {
+				return ""
+			}
+			labels = append(labels, string(raw[i+1:i+1+n]))
+			i += 1 + n
+		}
+		target = strings.Join(labels, ".")
+	} else {
+		target = strings.TrimSuffix(fields[1], ".")
+	}
+	if target == "" || target == "." {
+		return ""
+	}
+	return target
+}
+
+// selectFamily 按 FISSION_FAMILY 选择裂变使用的地址族，避免同一节点的 IPv4/IPv6 地址各裂变出一个节点：
+// both（默认）：全部保留；ipv4 / ipv6：只保留该地址族；
+// prefer-ipv4 / prefer-ipv6：优先地址族有结果时只保留优先地址族，否则使用另一地址族
+func selectFamily(ips []string, family string) []string {
+	var v4, v6 []string
+	for _, ip := range ips {
+		if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+			v6 = append(v6, ip)
+		} else {
+			v4 = append(v4, ip)
+		}
+	}
+	switch family {
+	case "ipv4":
+		return v4
+	case "ipv6":
+		return v6
+	case "prefer-ipv4":
+		if len(v4) > 0 {
+			return v4
+		}
+		return v6
+	case "prefer-ipv6":
+		if len(v6) > 0 {
+			return v6
+		}
+		return v4
+	}
+	return ips
+}
+
 // needSNI 判断节点类型是否需要 SNI
 func needSNI(typ string) bool {
 	// 可根据业务扩展
-	return typ == "trojan" || typ == "vmess"
+	return typ == "trojan" || typ == "vmess" || typ == "vless" || typ == "hysteria2" || typ == "tuic" || typ == "tuic-v5"
+}
+
+// fixNodeSNI 用原始域名补全需要 SNI 的节点的 sni：缺失时补全；
+// fixInvalid 为 true（FIX_SNI=1）时，明显无效的 sni（含空白、为 IP 等）视同缺失
+func fixNodeSNI(node *Node, originalServer string, fixInvalid bool) {
+	if !needSNI(node.Type) || !isDomain(originalServer) {
+		return
+	}
+	sni := node.Params["sni"]
+	if sni != "" && fixInvalid && !validSNI(sni) {
+		Warn("INGRESS", "[%s] %s 的 sni 无效（%q），替换为 %s", node.Source, node.OriginName, sni, originalServer)
+		sni = ""
+	}
+	if sni == "" {
+		node.Params["sni"] = originalServer
+	}
+}
+
+// validSNI 判断 sni 是否像合法主机名：非 IP，含点号，各标签仅由字母、数字和连字符组成
+func validSNI(sni string) bool {
+	if net.ParseIP(sni) != nil || !strings.Contains(sni, ".") || len(sni) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(sni, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
 }
 
 // isDomain 判断 server 是否为域名
@@ -178,5 +435,86 @@ func isDomain(server string) bool {
 func uniqueKey(n Node) string {
 	// 基于原始域名进行去重，而不是 DNS 查询后的 IP
 	// 这样不同的域名即使解析到同一个 IP 也不会被认为是重复的
+	// DEDUP_SCOPE=airport 时只在同一机场内去重，不同机场的相同节点各自保留
+	if os.Getenv("DEDUP_SCOPE") == "airport" {
+		return fmt.Sprintf("%s|%s|%s|%s", n.Source, n.Type, n.Server, n.Port)
+	}
 	return fmt.Sprintf("%s|%s|%s", n.Type, n.Server, n.Port)
 }
+
+// 节点名中的倍率标记，如 x2、×1.5；紧跟在英文字母后的 x 属于单词（如 "Linux 2"），不视为倍率
+var rateMarker = regexp.MustCompile(`(^|[^a-z])x\s*\d+(\.\d+)?|×\s*\d+(\.\d+)?`)
+
+// 节点名归一化时去掉的常见后缀（小写）
+var nameSuffixes = []string{"iplc", "iepl", "bgp", "premium", "专线", "中转", "直连", "高速"}
+
+// normalizeName 归一化节点名，用于按名称去重：
+// 1. 转为小写，去掉倍率标记（如 x2、×1.5）；
+// 2. 去掉 emoji/符号、标点、空白、数字及零宽/组合字符；
+// 3. 反复去掉末尾的常见后缀（如 IPLC、BGP、专线）。
+// 例如 "🇭🇰 香港 01 | IPLC" 与 "香港-02" 均归一化为 "香港"
+func normalizeName(name string) string {
+	var b strings.Builder
+	for _, r := range rateMarker.ReplaceAllString(strings.ToLower(name), "${1}") {
+		if unicode.IsDigit(r) || unicode.IsSpace(r) || unicode.IsPunct(r) || unicode.IsSymbol(r) ||
+			unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Cf, r) {
+			continue
+		}
+		b.WriteRune(r)
+	}
+	result := b.String()
+	for trimmed := true; trimmed; {
+		trimmed = false
+		for _, suffix := range nameSuffixes {
+			if len(result) > len(suffix) && strings.HasSuffix(result, suffix) {
+				result = strings.TrimSuffix(result, suffix)
+				trimmed = true
+			}
+		}
+	}
+	return result
+}
+
+// dedupByName 按归一化节点名去重，同名节点保留延迟最低的一个（延迟未知的排在已知之后）
+func dedupByName(ctx *UpdateContext) {
+	best := make(map[string]int) // 归一化名 -> ctx.Nodes 下标
+	var order []string
+	for i, node := range ctx.Nodes {
+		key := normalizeName(node.OriginName)
+		if key == "" {
+			key = stableID(node) // 名称归一化后为空时不参与按名去重
+		}
+		j, exists := best[key]
+		if !exists {
+			best[key] = i
+			order = append(order, key)
+			continue
+		}
+		if faster(node, ctx.Nodes[j]) {
+			best[key] = i
+			j, i = i, j
+		}
+		// 下标 i 为被淘汰的节点
+		loser := ctx.Nodes[i]
+		if stat := ctx.AirportStats[loser.Source]; stat != nil {
+			stat.Duplicated++
+			stat.Total--
+		}
+		ctx.dropNode(loser, DropDuplicate)
+	}
+
+	kept := make([]Node, 0, len(order))
+	for _, key := range order {
+		kept = append(kept, ctx.Nodes[best[key]])
+	}
+	Info("INGRESS", "按节点名去重: %d -> %d", len(ctx.Nodes), len(kept))
+	ctx.Nodes = kept
+}
+
+// faster 判断节点 a 是否比 b 延迟更低（延迟未知视为最慢）
+func faster(a, b Node) bool {
+	if a.Latency == 0 {
+		return false
+	}
+	return b.Latency == 0 || a.Latency < b.Latency
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"🇭🇰 香港 01 | IPLC", "香港"},
+		{"香港-02", "香港"},
+		{"🇯🇵 日本 | 东京 - 03", "日本东京"},
+		{"日本 x2", "日本"},
+		{"日本×1.5", "日本"},
+		{"US X0.5 BGP 专线", "us"},
+		{"新加坡x3 | Premium", "新加坡"},
+		{"Linux 2", "linux"}, // 单词中的 x 不是倍率标记
+		{"Xbox 01", "xbox"},
+		{"IPLC", "iplc"}, // 只有后缀时保留
+		{"🇭🇰", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeName(tt.name); got != tt.want {
+			t.Errorf("normalizeName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDedupByName(t *testing.T) {
+	node := func(source, name, server string, latency time.Duration) Node {
+		n := testNode(source, "HK", server)
+		n.OriginName = name
+		n.Latency = latency
+		return n
+	}
+	ctx := &UpdateContext{
+		Nodes: []Node{
+			node("A", "🇭🇰 香港 01 | IPLC", "1.1.1.1", 300*time.Millisecond),
+			node("B", "香港-02", "2.2.2.2", 100*time.Millisecond),
+			node("A", "Linux 2", "1.1.1.2", 0),
+			node("B", "Linu 2", "2.2.2.3", 0),
+			node("C", "香港 x2", "3.3.3.3", 0), // 延迟未知，排在已知之后
+		},
+		AirportStats: map[string]*Stat{"A": {Total: 2}, "B": {Total: 2}, "C": {Total: 1}},
+		Dropped:      make(map[string][]DropRecord),
+	}
+	dedupByName(ctx)
+
+	var kept []string
+	for _, n := range ctx.Nodes {
+		kept = append(kept, n.Server)
+	}
+	if want := []string{"2.2.2.2", "1.1.1.2", "2.2.2.3"}; !reflect.DeepEqual(kept, want) {
+		t.Errorf("保留节点 = %q, want %q", kept, want)
+	}
+	if s := ctx.AirportStats["A"]; s.Total != 1 || s.Duplicated != 1 {
+		t.Errorf("机场 A 统计 = %+v", *s)
+	}
+	if s := ctx.AirportStats["C"]; s.Total != 0 || s.Duplicated != 1 {
+		t.Errorf("机场 C 统计 = %+v", *s)
+	}
+	if got := ctx.Dropped["A"]; len(got) != 1 || got[0].Server != "1.1.1.1" || got[0].Reason != DropDuplicate {
+		t.Errorf("机场 A 丢弃记录 = %+v", got)
+	}
+}
+
+func TestValidSNI(t *testing.T) {
+	tests := []struct {
+		sni  string
+		want bool
+	}{
+		{"example.com", true},
+		{"cdn-1.example.com.", true},
+		{"", false},
+		{"1.2.3.4", false},
+		{"2001:db8::1", false},
+		{"exa mple.com", false},
+		{"localhost", false},
+		{"-bad.example.com", false},
+		{"a..example.com", false},
+	}
+	for _, tt := range tests {
+		if got := validSNI(tt.sni); got != tt.want {
+			t.Errorf("validSNI(%q) = %v, want %v", tt.sni, got, tt.want)
+		}
+	}
+}
+
+func TestFixNodeSNI(t *testing.T) {
+	tests := []struct {
+		name       string
+		typ        string
+		sni        string
+		server     string
+		fixInvalid bool
+		want       string
+	}{
+		{"empty sni filled", "trojan", "", "hk.example.com", false, "hk.example.com"},
+		{"ip sni replaced", "trojan", "1.2.3.4", "hk.example.com", true, "hk.example.com"},
+		{"sni with space replaced", "vmess", "bad sni.com", "hk.example.com", true, "hk.example.com"},
+		{"valid sni kept", "trojan", "cdn.example.net", "hk.example.com", true, "cdn.example.net"},
+		{"invalid sni kept without FIX_SNI", "trojan", "1.2.3.4", "hk.example.com", false, "1.2.3.4"},
+		{"ip server not used", "trojan", "", "5.6.7.8", true, ""},
+		{"type without sni", "ss", "", "hk.example.com", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := Node{Type: tt.typ, Server: tt.server, Params: map[string]string{}}
+			if tt.sni != "" {
+				node.Params["sni"] = tt.sni
+			}
+			fixNodeSNI(&node, tt.server, tt.fixInvalid)
+			if got := node.Params["sni"]; got != tt.want {
+				t.Errorf("sni = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// DoH JSON 桩：按查询的 name 和 type 返回预置应答
+func dohStub(t testing.TB, answers map[string]string) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		body, ok := answers[q.Get("name")+"/"+q.Get("type")]
+		if !ok {
+			body = `{"Status":0,"Answer":[]}`
+		}
+		w.Header().Set("Content-Type", "application/dns-json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestResolveHTTPSTarget(t *testing.T) {
+	ts := dohStub(t, map[string]string{
+		"presentation.example.com/65": `{"Status":0,"Answer":[{"name":"presentation.example.com","type":65,"data":"1 svc.example.net. alpn=h2"}]}`,
+		"self.example.com/65":         `{"Status":0,"Answer":[{"name":"self.example.com","type":65,"data":"1 . alpn=h2,h3"}]}`,
+		"generic.example.com/65":      `{"Status":0,"Answer":[{"name":"generic.example.com","type":65,"data":"\\# 19 00 01 03 73 76 63 07 65 78 61 6d 70 6c 65 03 6e 65 74 00"}]}`,
+		"generic-self.example.com/65": `{"Status":0,"Answer":[{"name":"generic-self.example.com","type":65,"data":"\\# 3 00 01 00"}]}`,
+		"cname.example.com/65":        `{"Status":0,"Answer":[{"name":"cname.example.com","type":5,"data":"alias.example.com."},{"name":"alias.example.com","type":65,"data":"1 svc.example.net."}]}`,
+		"nxdomain.example.com/65":     `{"Status":3}`,
+		"svc.example.net/1":           `{"Status":0,"Answer":[{"name":"svc.example.net","type":1,"data":"203.0.113.7"}]}`,
+	})
+	t.Setenv("DOH", ts.URL)
+
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{"presentation.example.com", "svc.example.net"},
+		{"self.example.com", ""},
+		{"generic.example.com", "svc.example.net"},
+		{"generic-self.example.com", ""},
+		{"cname.example.com", "svc.example.net"},
+		{"nxdomain.example.com", ""},
+		{"none.example.com", ""},
+	}
+	for _, tt := range tests {
+		if got := resolveHTTPSTarget(tt.domain); got != tt.want {
+			t.Errorf("resolveHTTPSTarget(%q) = %q, want %q", tt.domain, got, tt.want)
+		}
+	}
+
+	// DNS_HTTPS_RR=1 时解析目标域名的地址
+	t.Setenv("DNS_HTTPS_RR", "1")
+	t.Setenv("DNS_SYSTEM_FALLBACK", "")
+	ips, err := resolveADNS("presentation.example.com")
+	if err != nil || !reflect.DeepEqual(ips, []string{"203.0.113.7"}) {
+		t.Errorf("resolveADNS = %v, %v", ips, err)
+	}
+
+	// 未设置 DOH 时不查询 HTTPS 记录，直接使用系统 DNS
+	t.Setenv("DOH", "")
+	prev := dohClient
+	defer func() { dohClient = prev }()
+	dohClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		t.Errorf("未设置 DOH 时发出了 DoH 查询: %s", r.URL)
+		return nil, http.ErrNotSupported
+	})}
+	if ips, err := resolveADNS("203.0.113.9"); err != nil || !reflect.DeepEqual(ips, []string{"203.0.113.9"}) {
+		t.Errorf("resolveADNS = %v, %v", ips, err)
+	}
+}
+
+// roundTripFunc 以函数实现 http.RoundTripper
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// 对比共享 DoH 客户端与每次查询新建客户端：DoH 桩使用 TLS，新建客户端每次查询都要重新握手
+func BenchmarkQueryDoH(b *testing.B) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/dns-json")
+		w.Write([]byte(`{"Status":0,"Answer":[{"name":"hk.example.com","type":1,"data":"203.0.113.7"}]}`))
+	}))
+	defer ts.Close()
+	b.Setenv("DOH", ts.URL)
+
+	// 信任桩的自签证书，其余配置与 newDoHClient 一致
+	newClient := func() *http.Client {
+		c := newDoHClient()
+		c.Transport.(*http.Transport).TLSClientConfig = ts.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+		return c
+	}
+	prev := dohClient
+	defer func() { dohClient = prev }()
+
+	run := func(b *testing.B, perQuery bool) {
+		dohClient = newClient()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if perQuery {
+				dohClient.CloseIdleConnections()
+				dohClient = newClient()
+			}
+			if _, err := queryDoH("hk.example.com", dnsTypeA); err != nil {
+				b.Fatal(err)
+			}
+		}
+		dohClient.CloseIdleConnections()
+	}
+	b.Run("shared", func(b *testing.B) { run(b, false) })
+	b.Run("per-query", func(b *testing.B) { run(b, true) })
+}
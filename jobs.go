@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jobs.go
+// 更新任务：所有更新（接口触发、定时检查、SIGHUP 重新加载等）都以任务形式执行，
+// 同一时间只运行一个任务，任务运行期间的重复请求返回正在运行的任务。
+// 最近的任务及各阶段进度保存在内存中，供 /conflux/jobs 查询。
+
+// 任务和阶段状态
+const (
+	JobRunning = "running"
+	JobSuccess = "success"
+	JobFailed  = "failed"
+	StageDone  = "done"
+)
+
+// 更新流程的阶段
+const (
+	StageFetch   = "fetch"   // 拉取订阅，Count 为拉取成功的机场数
+	StageIngress = "ingress" // 解析和入口处理，Count 为入口处理后的节点数
+	StageEgress  = "egress"  // 出口检测，Count 为检测通过的节点数
+	StageWrite   = "write"   // 写入 node.conf，Count 为写入的节点数
+)
+
+// Job 结构体：一次更新任务
+// Trigger: 触发来源（api / schedule / reload / request）
+// Stages: 已开始的阶段，按执行顺序
+type Job struct {
+	ID       string     `json:"id"`
+	Trigger  string     `json:"trigger"`
+	Status   string     `json:"status"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Stages   []JobStage `json:"stages"`
+
+	done chan struct{} // 任务结束时关闭
+}
+
+// JobStage 结构体：任务中的一个阶段
+type JobStage struct {
+	Name     string     `json:"name"`
+	Status   string     `json:"status"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Count    int        `json:"count"`
+}
+
+var (
+	jobsMu     sync.Mutex
+	currentJob *Job
+	jobHistory []*Job // 最近的任务，按启动时间从旧到新，包含正在运行的任务
+)
+
+// 保留的任务数 JOB_HISTORY，默认 20
+func jobHistorySize() int {
+	if n, err := strconv.Atoi(os.Getenv("JOB_HISTORY")); err == nil && n > 0 {
+		return n
+	}
+	return 20
+}
+
+// 启动更新任务，返回任务和是否新建；已有任务运行时不重复启动，返回正在运行的任务
+func startUpdateJob(trigger string) (*Job, bool) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if currentJob != nil {
+		return currentJob, false
+	}
+	job := &Job{
+		ID:      genToken(16),
+		Trigger: trigger,
+		Status:  JobRunning,
+		Started: time.Now(),
+		Stages:  []JobStage{},
+		done:    make(chan struct{}),
+	}
+	currentJob = job
+	jobHistory = append(jobHistory, job)
+	if size := jobHistorySize(); len(jobHistory) > size {
+		jobHistory = jobHistory[len(jobHistory)-size:]
+	}
+	Info("UPDATE", "启动更新任务 %s（%s）", job.ID, trigger)
+	publishJob(job)
+	go job.run()
+	return job, true
+}
+
+// 执行更新并记录结果
+func (job *Job) run() {
+	ok := updateNodes()
+	jobsMu.Lock()
+	finished := time.Now()
+	job.Finished = &finished
+	job.Status = JobSuccess
+	if !ok {
+		job.Status = JobFailed
+	}
+	job.endStage(finished, ok)
+	publishJob(job)
+	currentJob = nil
+	jobsMu.Unlock()
+	close(job.done)
+}
+
+// 结束正在运行的阶段（调用方持有 jobsMu）
+func (job *Job) endStage(at time.Time, ok bool) {
+	if len(job.Stages) == 0 {
+		return
+	}
+	stage := &job.Stages[len(job.Stages)-1]
+	if stage.Status != JobRunning {
+		return
+	}
+	stage.Finished = &at
+	stage.Status = StageDone
+	if !ok {
+		stage.Status = JobFailed
+	}
+}
+
+// 进入下一阶段，上一阶段标记为完成；不在任务中执行更新时忽略
+func jobStage(name string) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if currentJob == nil {
+		return
+	}
+	now := time.Now()
+	currentJob.endStage(now, true)
+	currentJob.Stages = append(currentJob.Stages, JobStage{Name: name, Status: JobRunning, Started: now})
+	publishJob(currentJob)
+}
+
+// 记录当前阶段的计数
+func jobStageCount(count int) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if currentJob == nil || len(currentJob.Stages) == 0 {
+		return
+	}
+	currentJob.Stages[len(currentJob.Stages)-1].Count = count
+	publishJob(currentJob)
+}
+
+// 任务快照（调用方持有 jobsMu 时使用，避免并发读写字段）
+func (job *Job) snapshot() Job {
+	snap := *job
+	snap.Stages = append([]JobStage{}, job.Stages...)
+	snap.done = nil
+	return snap
+}
+
+// 需要 update 权限的接口：token 校验失败返回 401，无 update 权限返回 403
+func requireUpdate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !validateToken(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("invalid token"))
+			return
+		}
+		if !hasScope(r, ScopeUpdate) {
+			Warn("HTTP", "token 无更新权限: %s", r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("forbidden"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// 处理 POST /conflux/update：启动更新任务并立即返回任务 ID
+// 已有任务运行时返回 409 和正在运行的任务，调用方可继续轮询该任务
+func handleUpdate(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	if readOnly() {
+		Warn("HTTP", "维护模式下拒绝更新请求")
+		w.WriteHeader(http.StatusLocked)
+		w.Write([]byte("read-only mode"))
+		return
+	}
+	writeJobResponse(w, "api")
+}
+
+// 启动任务并返回 JSON：新建返回 202，已有任务运行返回 409
+func writeJobResponse(w http.ResponseWriter, trigger string) {
+	job, created := startUpdateJob(trigger)
+	jobsMu.Lock()
+	snap := job.snapshot()
+	jobsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if created {
+		w.WriteHeader(http.StatusAccepted)
+	} else {
+		Warn("HTTP", "更新任务 %s 正在运行，拒绝重复请求", snap.ID)
+		w.WriteHeader(http.StatusConflict)
+	}
+	json.NewEncoder(w).Encode(snap)
+}
+
+// 处理 GET /conflux/jobs：返回最近的任务，最新的在前
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	jobsMu.Lock()
+	jobs := make([]Job, 0, len(jobHistory))
+	for i := len(jobHistory) - 1; i >= 0; i-- {
+		jobs = append(jobs, jobHistory[i].snapshot())
+	}
+	jobsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+// 处理 GET /conflux/jobs/{id}：返回单个任务，不存在（或已超出保留数量）时返回 404
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/conflux/jobs/")
+	jobsMu.Lock()
+	var snap *Job
+	for _, job := range jobHistory {
+		if job.ID == id {
+			s := job.snapshot()
+			snap = &s
+			break
+		}
+	}
+	jobsMu.Unlock()
+
+	if snap == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("job not found"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(snap)
+}
@@ -6,17 +6,25 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 var Version = "dev"
 
+// 进程启动时间
+var startTime = time.Now()
+
 // 日志级别常量
 const (
+	DEBUG = "DEBUG"
 	INFO  = "INFO"
 	WARN  = "WARN"
 	ERROR = "ERROR"
@@ -59,6 +67,13 @@ func Info(module, format string, v ...interface{})  { logf(INFO, module, format,
 func Warn(module, format string, v ...interface{})  { logf(WARN, module, format, v...) }
 func Error(module, format string, v ...interface{}) { logf(ERROR, module, format, v...) }
 
+// 调试日志：仅在 LOG_LEVEL=debug 时输出
+func Debug(module, format string, v ...interface{}) {
+	if strings.EqualFold(os.Getenv("LOG_LEVEL"), "debug") {
+		logf(DEBUG, module, format, v...)
+	}
+}
+
 // 获取本周一0点的时间（用于日志文件命名和切割）
 func getMondayZero(now time.Time) time.Time {
 	offset := (int(now.Weekday()) + 6) % 7 // 周一为0
@@ -96,12 +111,12 @@ func getToken(tokenPath string) string {
 	if token != "" {
 		return token
 	}
-	if data, err := os.ReadFile(tokenPath); err == nil {
+	if data, err := readDataFile(tokenPath); err == nil {
 		token = strings.TrimSpace(string(data))
 		return token
 	}
 	token = genToken(32)
-	if err := os.WriteFile(tokenPath, []byte(token), 0644); err != nil {
+	if err := writeDataFile(tokenPath, []byte(token)); err != nil {
 		Error("TOKEN", "写入 token 文件失败: %v", err)
 	} else {
 		Info("TOKEN", "自动生成并写入 TOKEN: %s", token)
@@ -109,31 +124,128 @@ func getToken(tokenPath string) string {
 	return token
 }
 
+// 轮换前的主 token，在 TOKEN_GRACE 宽限期内仍然有效（仅保存在内存中，重启后失效）
+var (
+	prevTokenMu     sync.Mutex
+	prevToken       string
+	prevTokenExpiry time.Time
+)
+
+// 读取旧 token 宽限期 TOKEN_GRACE（Go duration 格式），默认 0 表示轮换后旧 token 立即失效
+func tokenGrace() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("TOKEN_GRACE"))
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+// 轮换主 token：生成新 token 写入 token 文件，旧 token 进入宽限期
+// TOKEN 环境变量指定的 token 无法轮换
+func rotateToken(tokenPath string) (string, error) {
+	if os.Getenv("TOKEN") != "" {
+		return "", fmt.Errorf("token 由 TOKEN 环境变量指定，无法轮换")
+	}
+	old := getToken(tokenPath)
+	token := genToken(32)
+	if err := writeDataFile(tokenPath, []byte(token)); err != nil {
+		return "", err
+	}
+	if grace := tokenGrace(); grace > 0 {
+		prevTokenMu.Lock()
+		prevToken, prevTokenExpiry = old, time.Now().Add(grace)
+		prevTokenMu.Unlock()
+	}
+	Info("TOKEN", "主 token 已轮换，旧 token 宽限期 %s", tokenGrace())
+	return token, nil
+}
+
+// 判断是否为宽限期内的旧 token
+func inTokenGrace(token string) bool {
+	prevTokenMu.Lock()
+	defer prevTokenMu.Unlock()
+	return prevToken != "" && token == prevToken && time.Now().Before(prevTokenExpiry)
+}
+
+// 维护模式：READ_ONLY=1 时停止所有更新，仅提供现有 node.conf
+func readOnly() bool {
+	return os.Getenv("READ_ONLY") == "1"
+}
+
 // 合并定时/条件触发的 node.conf 检查逻辑
 func manageNodeConf(nodeConf string) {
+	// 等待任务结束（已有任务运行时等待该任务），避免下次检查与其重叠
+	update := func() {
+		job, _ := startUpdateJob("schedule")
+		<-job.done
+	}
 	check := func() {
-		info, err := os.Stat(nodeConf)
+		modTime, err := dataFileModTime(nodeConf)
 		if os.IsNotExist(err) {
 			Warn("CONF", "未检测到 node.conf，自动执行 update")
-			updateNodes()
+			update()
 			return
 		}
-		if err == nil && time.Since(info.ModTime()) > 24*time.Hour {
+		if err == nil && time.Since(modTime) > staleAfter {
 			Warn("CONF", "node.conf 超过 24 小时未更新，自动执行 update")
-			updateNodes()
+			update()
 		}
 	}
-	// 启动时检查一次
-	check()
-	// 定时任务：每隔6小时检查 node.conf 是否超时未更新
+	// 启动时检查一次（后台执行，HTTP 服务可先启动，/readyz 在首次更新完成前返回未就绪）
+	// 定时任务：每隔 UPDATE_INTERVAL（默认 6 小时）检查 node.conf 是否超时未更新
 	go func() {
+		check()
 		for {
-			time.Sleep(6 * time.Hour)
+			time.Sleep(updateInterval())
 			check()
 		}
 	}()
 }
 
+// node.conf 超过该时长未更新时，定时检查自动执行更新
+const staleAfter = 24 * time.Hour
+
+// 定时检查间隔 UPDATE_INTERVAL，默认 6h
+func updateInterval() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("UPDATE_INTERVAL")); err == nil && d > 0 {
+		return d
+	}
+	return 6 * time.Hour
+}
+
+// SIGHUP 重新加载：重新读取订阅文件、token 文件并触发更新，HTTP 服务和当前 node.conf 保持可用
+// 环境变量派生的配置均在使用时读取，无需额外缓存刷新
+func handleReload(tokenPath string) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		for range sigs {
+			airports := loadAirports()
+			names := make([]string, 0, len(airports))
+			for name := range airports {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			Info("SYS", "收到 SIGHUP，重新加载订阅: %d 个机场 [%s]", len(names), strings.Join(names, ", "))
+
+			tokenSource := "文件 " + tokenPath
+			if os.Getenv("TOKEN") != "" {
+				tokenSource = "环境变量 TOKEN"
+			}
+			_ = getToken(tokenPath)
+			Info("SYS", "重新加载 token: 来源 %s", tokenSource)
+
+			if readOnly() {
+				Info("SYS", "重新加载完成，维护模式下跳过更新")
+				continue
+			}
+			if job, created := startUpdateJob("reload"); !created {
+				Info("SYS", "重新加载完成，更新任务 %s 正在运行，跳过更新", job.ID)
+			}
+		}
+	}()
+}
+
 // 日志文件自动切换：每到周一切换新日志文件
 func startLogRotator(logDir string, monday *time.Time) {
 	go func() {
@@ -157,41 +269,71 @@ func startLogRotator(logDir string, monday *time.Time) {
 func main() {
 	// 系统会自动使用 TZ 环境变量，无需手动设置
 
-	// 统一创建主目录和日志目录
+	// 统一创建主目录和日志目录，IN_MEMORY=1 或目录不可写时进入内存模式，日志只输出到标准输出
 	baseDir := "/data/conflux"
 	logDir := filepath.Join(baseDir, "log")
-	if err := os.MkdirAll(logDir, 0755); err != nil {
-		fmt.Printf("[ERROR] 创建日志目录失败: %v\n", err)
-		os.Exit(1)
+	memReason := ""
+	if os.Getenv("IN_MEMORY") == "1" {
+		memReason = "IN_MEMORY=1"
+	} else if err := dataDirWritable(logDir); err != nil {
+		memReason = fmt.Sprintf("数据目录不可写: %v", err)
 	}
 
-	now := time.Now()
-	monday := getMondayZero(now)
-	// 使用当前时间命名初始日志文件
-	logFile := filepath.Join(logDir, now.Format("2006-01-02-15-04-05")+".log")
-	if err := InitLog(logFile); err != nil {
-		fmt.Printf("[ERROR] 日志文件创建失败: %v\n", err)
-		os.Exit(1)
+	if memReason != "" {
+		log.SetOutput(os.Stdout)
+		log.SetFlags(log.LstdFlags)
+		enableMemory(memReason)
+	} else {
+		now := time.Now()
+		monday := getMondayZero(now)
+		// 使用当前时间命名初始日志文件
+		logFile := filepath.Join(logDir, now.Format("2006-01-02-15-04-05")+".log")
+		if err := InitLog(logFile); err != nil {
+			fmt.Printf("[ERROR] 日志文件创建失败: %v\n", err)
+			os.Exit(1)
+		}
+		defer CloseLog()
+		cleanOldLogs(logDir, 7)
+		startLogRotator(logDir, &monday)
 	}
-	defer CloseLog()
 	Info("SYS", "版本号: %s", Version)
 	Info("SYS", "工作目录: %s", getCurrentDir())
-	cleanOldLogs(logDir, 7)
-	startLogRotator(logDir, &monday)
+	if addr := os.Getenv("BIND_ADDR"); addr != "" {
+		if net.ParseIP(addr) == nil {
+			Error("SYS", "BIND_ADDR 不是合法 IP，忽略: %s", addr)
+		} else {
+			Info("SYS", "出站源地址: %s", addr)
+		}
+	}
 
 	// 2. TOKEN 管理
 	tokenPath := filepath.Join(baseDir, "token")
 	_ = getToken(tokenPath)
 
-	// 3. 节点配置文件检查与自动更新
+	// 3. 节点配置文件检查与自动更新（维护模式下停止所有更新）
 	nodeConf := filepath.Join(baseDir, "node.conf")
-	manageNodeConf(nodeConf)
+	if readOnly() {
+		Warn("SYS", "维护模式已开启（READ_ONLY=1）：停止自动更新，仅提供现有 node.conf")
+	} else {
+		manageNodeConf(nodeConf)
+	}
+
+	// 4. SIGHUP 重新加载配置
+	handleReload(tokenPath)
 
-	// 4. 启动 HTTP 服务
-	Info("HTTP", "启动 HTTP 服务... 监听端口 80 ")
+	// 5. 启动 HTTP 服务
 	startServer()
 }
 
+// 创建出站拨号器：设置 BIND_ADDR 时从指定源地址发起连接（多出口主机指定出口）
+func newDialer() *net.Dialer {
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	if ip := net.ParseIP(os.Getenv("BIND_ADDR")); ip != nil {
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	return d
+}
+
 // 获取当前工作目录
 func getCurrentDir() string {
 	if dir, err := os.Getwd(); err == nil {
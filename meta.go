@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// meta.go
+// 节点元数据：按 StableID 记录跨多次更新的节点状态（如连续失败次数），持久化到 meta.json。
+
+// NodeMeta 结构体：单个节点的跨更新状态
+// FailStreak: 连续检测失败次数
+// LastFail: 最近一次检测失败时间
+// Latencies: 最近若干次检测成功的延迟（毫秒），最多保留 LATENCY_HISTORY 条
+// LastISO / LastEmoji: 最近一次检测成功的出口地区，GEO_GRACE 宽限期内沿用
+
+type NodeMeta struct {
+	FailStreak int       `json:"fail_streak"`
+	LastFail   time.Time `json:"last_fail"`
+	Latencies  []int64   `json:"latencies,omitempty"`
+	LastISO    string    `json:"last_iso,omitempty"`
+	LastEmoji  string    `json:"last_emoji,omitempty"`
+}
+
+const metaPath = "/data/conflux/meta.json"
+
+// stableID 生成节点跨更新稳定的标识（类型 + 服务器 + 端口）
+func stableID(n Node) string {
+	return fmt.Sprintf("%s|%s|%s", n.Type, n.Server, n.Port)
+}
+
+// loadMeta 读取节点元数据，文件不存在或损坏时返回空表
+func loadMeta() map[string]*NodeMeta {
+	meta := make(map[string]*NodeMeta)
+	data, err := readDataFile(metaPath)
+	if err != nil {
+		return meta
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		Warn("META", "解析 meta.json 失败: %v", err)
+		return make(map[string]*NodeMeta)
+	}
+	return meta
+}
+
+// saveMeta 写入节点元数据
+func saveMeta(meta map[string]*NodeMeta) {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		Error("META", "序列化 meta.json 失败: %v", err)
+		return
+	}
+	if err := writeDataFile(metaPath, data); err != nil {
+		Error("META", "写入 meta.json 失败: %v", err)
+	}
+}
+
+// latencyHistorySize 读取延迟历史保留条数 LATENCY_HISTORY，0 或未设置表示不记录
+func latencyHistorySize() int {
+	n, err := strconv.Atoi(os.Getenv("LATENCY_HISTORY"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// LatencySummary 结构体：单个节点的延迟历史统计（毫秒）
+type LatencySummary struct {
+	Name    string `json:"name"`
+	Source  string `json:"source"`
+	Samples int    `json:"samples"`
+	Min     int64  `json:"min"`
+	Avg     int64  `json:"avg"`
+	Max     int64  `json:"max"`
+}
+
+// summarizeLatency 按当前 nodes.json 中的节点汇总延迟历史
+func summarizeLatency(nodes []Node, meta map[string]*NodeMeta) []LatencySummary {
+	result := []LatencySummary{}
+	for _, node := range nodes {
+		m := meta[stableID(node)]
+		if m == nil || len(m.Latencies) == 0 {
+			continue
+		}
+		s := LatencySummary{Name: node.Name, Source: node.Source, Samples: len(m.Latencies), Min: m.Latencies[0], Max: m.Latencies[0]}
+		var total int64
+		for _, l := range m.Latencies {
+			total += l
+			if l < s.Min {
+				s.Min = l
+			}
+			if l > s.Max {
+				s.Max = l
+			}
+		}
+		s.Avg = total / int64(len(m.Latencies))
+		result = append(result, s)
+	}
+	return result
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics.go
+// Prometheus 指标：手写文本格式（text/plain; version=0.0.4），不引入 client_golang。
+// 指标在进程内累计，重启后清零。
+
+// 直方图桶（秒），用于节点检测延迟和 HTTP 请求耗时
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metric 一个指标及其所有标签组合
+// kind: counter / gauge / histogram
+type metric struct {
+	name   string
+	kind   string
+	help   string
+	labels []string
+	series map[string]*series // 键为渲染后的标签，如 airport="a",result="success"
+}
+
+// series 单个标签组合的取值；直方图的 buckets 为各桶计数（非累计）
+type series struct {
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   []*metric
+
+	// 最近一次更新的出口地区分布（egress 的 ctx.Regions），与 conflux_region_nodes 同源，供 /conflux/status 使用
+	lastRegions map[string]int
+)
+
+var (
+	fetchTotal          = newMetric("conflux_fetch_total", "counter", "订阅拉取次数", "airport", "result")
+	nodesParsedTotal    = newMetric("conflux_nodes_parsed_total", "counter", "解析出的节点数", "airport")
+	nodesDedupedTotal   = newMetric("conflux_nodes_deduplicated_total", "counter", "去重丢弃的节点数", "airport")
+	nodesFailedTotal    = newMetric("conflux_nodes_failed_total", "counter", "ingress 或 egress 检测失败的节点数", "airport")
+	egressFailuresTotal = newMetric("conflux_egress_failures_total", "counter", "egress 检测失败按类型细分的节点数", "airport", "kind")
+	airportNodes        = newMetric("conflux_airport_nodes", "gauge", "最近一次更新检测成功的节点数", "airport")
+	regionNodes         = newMetric("conflux_region_nodes", "gauge", "最近一次更新检测成功的节点按出口地区的分布", "iso")
+	egressLatency       = newMetric("conflux_egress_latency_seconds", "histogram", "节点出口检测延迟", "airport")
+	updatesTotal        = newMetric("conflux_updates_total", "counter", "更新次数", "result")
+	updateDuration      = newMetric("conflux_update_duration_seconds", "gauge", "最近一次更新耗时")
+	lastUpdateTimestamp = newMetric("conflux_last_update_timestamp_seconds", "gauge", "最近一次更新完成时间")
+	httpRequestsTotal   = newMetric("conflux_http_requests_total", "counter", "HTTP 请求数", "path", "code")
+	httpDuration        = newMetric("conflux_http_request_duration_seconds", "histogram", "HTTP 请求耗时", "path")
+)
+
+// 注册指标（包初始化时调用）
+func newMetric(name, kind, help string, labels ...string) *metric {
+	m := &metric{name: name, kind: kind, help: help, labels: labels, series: make(map[string]*series)}
+	metrics = append(metrics, m)
+	return m
+}
+
+// 取得标签组合对应的取值（调用方持有 metricsMu）
+func (m *metric) get(values []string) *series {
+	pairs := make([]string, len(m.labels))
+	for i, label := range m.labels {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs[i] = fmt.Sprintf(`%s="%s"`, label, escapeLabel(v))
+	}
+	key := strings.Join(pairs, ",")
+	s := m.series[key]
+	if s == nil {
+		s = &series{}
+		if m.kind == "histogram" {
+			s.buckets = make([]uint64, len(latencyBuckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metric) add(v float64, labels ...string) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	m.get(labels).value += v
+}
+
+func (m *metric) set(v float64, labels ...string) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	m.get(labels).value = v
+}
+
+// observe 记录直方图样本，value 累计样本总和
+func (m *metric) observe(v float64, labels ...string) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	s := m.get(labels)
+	s.value += v
+	s.count++
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			s.buckets[i]++
+			break
+		}
+	}
+}
+
+// reset 清空所有标签组合，用于按更新结果整体重建的 gauge（如已移除的机场）
+func (m *metric) reset() {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	m.series = make(map[string]*series)
+}
+
+// 转义标签值中的反斜杠、双引号和换行
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// 在标签后追加一项，如 le="0.5"
+func withLabel(key, pair string) string {
+	if key == "" {
+		return "{" + pair + "}"
+	}
+	return "{" + key + "," + pair + "}"
+}
+
+// 按 Prometheus 文本格式输出所有指标
+func writeMetrics(w io.Writer) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	sorted := append([]*metric(nil), metrics...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+	for _, m := range sorted {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		keys := make([]string, 0, len(m.series))
+		for key := range m.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := m.series[key]
+			labels := ""
+			if key != "" {
+				labels = "{" + key + "}"
+			}
+			if m.kind != "histogram" {
+				fmt.Fprintf(w, "%s%s %s\n", m.name, labels, formatFloat(s.value))
+				continue
+			}
+			var cumulative uint64
+			for i, bound := range latencyBuckets {
+				cumulative += s.buckets[i]
+				fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, withLabel(key, `le="`+formatFloat(bound)+`"`), cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, withLabel(key, `le="+Inf"`), s.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, formatFloat(s.value))
+			fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, s.count)
+		}
+	}
+}
+
+// 记录一次更新的节点统计：parsed 为解析出的节点，其余取自 ingress/egress 后的机场统计
+func recordNodeMetrics(parsed []Node, ctx *UpdateContext) {
+	counts := make(map[string]int)
+	for _, node := range parsed {
+		counts[node.Source]++
+	}
+	for airport, count := range counts {
+		nodesParsedTotal.add(float64(count), airport)
+	}
+	airportNodes.reset()
+	for airport, stat := range ctx.AirportStats {
+		nodesDedupedTotal.add(float64(stat.Duplicated), airport)
+		nodesFailedTotal.add(float64(stat.Failed), airport)
+		egressFailuresTotal.add(float64(stat.ConnectFailed), airport, "connect")
+		egressFailuresTotal.add(float64(stat.ReadFailed), airport, "read")
+		egressFailuresTotal.add(float64(stat.GeoFailed), airport, "geo")
+		airportNodes.set(float64(stat.Total), airport)
+	}
+	// 地区只保留本次出现的，已无节点的地区不再输出
+	regionNodes.reset()
+	regions := make(map[string]int, len(ctx.Regions))
+	for iso, count := range ctx.Regions {
+		regionNodes.set(float64(count), iso)
+		regions[iso] = count
+	}
+	metricsMu.Lock()
+	lastRegions = regions
+	metricsMu.Unlock()
+}
+
+// 最近一次更新的出口地区分布副本，本进程尚未完成检测时为空
+func currentRegions() map[string]int {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	regions := make(map[string]int, len(lastRegions))
+	for iso, count := range lastRegions {
+		regions[iso] = count
+	}
+	return regions
+}
+
+// 记录一次更新的结果和耗时
+func recordUpdateMetrics(start, end time.Time, ok bool) {
+	result := "success"
+	if !ok {
+		result = "failure"
+	}
+	updatesTotal.add(1, result)
+	updateDuration.set(end.Sub(start).Seconds())
+	lastUpdateTimestamp.set(float64(end.Unix()))
+}
+
+// HTTP 指标中间件：按路由模式（而非原始路径）统计请求数和耗时，避免标签基数失控
+func instrumentHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		path := "other"
+		if _, pattern := http.DefaultServeMux.Handler(r); pattern != "" {
+			path = pattern
+		}
+		httpRequestsTotal.add(1, path, strconv.Itoa(status))
+		httpDuration.observe(time.Since(start).Seconds(), path)
+	})
+}
+
+// 处理 /metrics：输出 Prometheus 指标，鉴权方式与诊断接口相同
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w)
+
+	// 运行时指标在抓取时计算
+	updateStateMu.Lock()
+	running := 0
+	if updateRunning > 0 {
+		running = 1
+	}
+	updateStateMu.Unlock()
+	fmt.Fprintf(w, "# HELP conflux_update_running 是否正在更新\n# TYPE conflux_update_running gauge\nconflux_update_running %d\n", running)
+	fmt.Fprintf(w, "# HELP conflux_build_info 版本信息\n# TYPE conflux_build_info gauge\nconflux_build_info{version=\"%s\"} 1\n", escapeLabel(Version))
+	fmt.Fprintf(w, "# HELP process_start_time_seconds 进程启动时间\n# TYPE process_start_time_seconds gauge\nprocess_start_time_seconds %d\n", startTime.Unix())
+	fmt.Fprintf(w, "# HELP go_goroutines 当前 goroutine 数\n# TYPE go_goroutines gauge\ngo_goroutines %d\n", runtime.NumGoroutine())
+}
@@ -1,68 +1,682 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // server.go
-// HTTP 服务，监听 80 端口，处理 /conflux 路由的 API 请求。
+// HTTP 服务，默认监听 80 端口（LISTEN 可配置，HTTPS 见 tls.go），处理 /conflux 路由的 API 请求。
 
-// 启动 HTTP 服务
+// 监听地址 LISTEN，默认 :80，启用 HTTPS 时默认 :443
+func listenAddr() string {
+	if addr := os.Getenv("LISTEN"); addr != "" {
+		return addr
+	}
+	if tlsEnabled() {
+		return ":443"
+	}
+	return ":80"
+}
+
+// 启动 HTTP(S) 服务，监听失败时退出
 func startServer() {
-	http.HandleFunc("/conflux", handleConflux)
-	http.ListenAndServe(":80", nil)
+	checkQueryParams()
+	http.HandleFunc("/conflux", rateLimit(handleConflux))
+	http.HandleFunc("/conflux/config", requireAdmin(handleConfig))
+	http.HandleFunc("/conflux/logs", requireAdmin(handleLogs))
+	http.HandleFunc("/validate", handleValidate)
+	http.HandleFunc("/conflux/fingerprint", handleFingerprint)
+	http.HandleFunc("/conflux/latency", requireAdmin(handleLatency))
+	http.HandleFunc("/conflux/nodes.csv", handleNodesCSV)
+	http.HandleFunc("/conflux/diff", handleDiff)
+	http.HandleFunc("/conflux/token/rotate", requireAdmin(handleTokenRotate))
+	http.HandleFunc("/conflux/sign", requireAdmin(handleSign))
+	http.HandleFunc("/conflux/status", requireAdmin(handleStatus))
+	http.HandleFunc("/conflux/stats", requireAdmin(handleStats))
+	http.HandleFunc("/conflux/update", requireUpdate(handleUpdate))
+	http.HandleFunc("/conflux/jobs", requireUpdate(handleJobs))
+	http.HandleFunc("/conflux/jobs/", requireUpdate(handleJob))
+	http.HandleFunc("/conflux/events", requireUpdate(handleEvents))
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
+	http.HandleFunc("/metrics", requireAdmin(handleMetrics))
+	go startDebugServer()
+	srv := &http.Server{Addr: listenAddr(), Handler: instrumentHTTP(ipFilter(lockoutGuard(hideDebug(http.DefaultServeMux))))}
+	if err := listenAndServe(srv); err != nil {
+		Error("HTTP", "HTTP 服务启动失败 (%s): %v", srv.Addr, err)
+		os.Exit(1)
+	}
 }
 
 // 处理 /conflux 路由的主入口
 func handleConflux(w http.ResponseWriter, r *http.Request) {
 	logRequest(r)
 	setCORSHeaders(w)
-	if r.Method == http.MethodOptions {
+	switch r.Method {
+	case http.MethodOptions:
 		w.WriteHeader(http.StatusNoContent)
 		return
+	case http.MethodGet, http.MethodHead:
+	default:
+		// 仅允许 GET/HEAD/OPTIONS，其他方法不读取配置
+		Warn("HTTP", "不支持的请求方法: %s", r.Method)
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
 	}
 
 	if !validateToken(r) {
-		Warn("HTTP", "Token 校验失败: %s", r.URL.Query().Get("t"))
+		// 区分未提供和错误的 token，便于排查客户端配置；状态码保持一致
 		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("invalid token"))
+		if token := requestToken(r); token == "" {
+			Warn("HTTP", "未提供 token")
+			w.Write([]byte("missing token"))
+		} else {
+			Warn("HTTP", "Token 校验失败: %s", token)
+			w.Write([]byte("invalid token"))
+		}
 		return
 	}
 
 	if isForceUpdate(r) {
-		Info("HTTP", "收到强制更新请求，异步执行 updateNodes")
-		go updateNodes()
-		w.WriteHeader(http.StatusAccepted)
-		w.Write([]byte("update triggered"))
+		if !hasScope(r, ScopeUpdate) {
+			Warn("HTTP", "token 无强制更新权限")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("forbidden"))
+			return
+		}
+		if readOnly() {
+			Warn("HTTP", "维护模式下拒绝强制更新请求")
+			w.WriteHeader(http.StatusLocked)
+			w.Write([]byte("read-only mode"))
+			return
+		}
+		// 兼容旧的强制更新参数，等同于 POST /conflux/update
+		Info("HTTP", "收到强制更新请求")
+		writeJobResponse(w, "api")
 		return
 	}
 
 	nodeConf := "/data/conflux/node.conf"
 	if !nodeConfExists(nodeConf) {
-		Warn("HTTP", "node.conf 不存在，异步执行 updateNodes")
-		go updateNodes()
+		if readOnly() {
+			Warn("HTTP", "node.conf 不存在，维护模式下不执行更新")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("node.conf not found"))
+			return
+		}
+		Warn("HTTP", "node.conf 不存在，异步执行更新")
+		startUpdateJob("request")
 		w.WriteHeader(http.StatusNoContent)
 		w.Write([]byte("node.conf updating"))
 		return
 	}
 
-	lines, err := loadNodeConf(nodeConf)
+	fingerprint, err := nodeConfFingerprint(nodeConf)
 	if err != nil {
 		Error("HTTP", "读取 node.conf 失败: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("read node.conf error"))
 		return
 	}
+	// ?profile= 使用服务端预设的参数组合，请求中的其他参数覆盖预设中的同名参数
+	query, err := applyProfile(r.URL.Query())
+	if err != nil {
+		Warn("HTTP", "%v", err)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("unknown profile"))
+		return
+	}
+	// ?format= 选择输出格式，未设置时按 User-Agent 识别客户端，仍无法识别则输出 Surge 代理行
+	// 按 User-Agent 识别时响应随 User-Agent 变化，需声明 Vary，避免共享缓存把一种格式返回给其他客户端
+	if query.Get("format") == "" {
+		w.Header().Set("Vary", "User-Agent")
+		if detected := detectFormat(r.UserAgent()); detected != "" {
+			Debug("HTTP", "按 User-Agent 识别输出格式: %s (%s)", detected, r.UserAgent())
+			query.Set("format", detected) // 写回参数，使 ETag 随识别结果变化
+		}
+	}
+	formatName := query.Get("format")
+	format, formatOK := outputFormats[formatName]
+	if formatName != "" && formatName != "surge" && !formatOK {
+		Warn("HTTP", "不支持的输出格式: %s", formatName)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("unknown format"))
+		return
+	}
 
-	params := r.URL.Query()
-	result := processNodes(lines, params)
+	etag, err := nodeConfETag(nodeConf, query.Encode()+templateDigest())
+	if err != nil {
+		Error("HTTP", "读取 node.conf 失败: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("read node.conf error"))
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(cacheMaxAge(nodeConf).Seconds())))
+	if match := r.Header.Get("If-None-Match"); match != "" && strings.Contains(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	f, err := openDataFile(nodeConf)
+	if err != nil {
+		Error("HTTP", "读取 node.conf 失败: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("read node.conf error"))
+		return
+	}
+	defer f.Close()
 
+	w.Header().Set("X-Conflux-Fingerprint", fingerprint)
+	if formatOK {
+		nodes, err := loadOutputNodes(f, query)
+		if err != nil {
+			Error("HTTP", "读取 node.conf 失败: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("read node.conf error"))
+			return
+		}
+		w.Header().Set("Content-Type", format.contentType)
+		if err := format.render(w, nodes, renderContext{query: query, url: requestURL(r)}); err != nil {
+			Error("HTTP", "输出 %s 格式失败: %v", formatName, err)
+		}
+		return
+	}
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	// 设置 DOWNLOAD_NAME 时浏览器下载使用该文件名，默认不设置以免影响程序化拉取
+	if name := os.Getenv("DOWNLOAD_NAME"); name != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	}
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(strings.Join(result, "\n")))
+	streamNodes(w, f, query)
+}
+
+// profiles.conf 路径：每行一个预设，格式 名称 = 查询参数，如 mobile = iso=HK,JP&type=trojan&udp=1
+const profilesPath = "/data/conflux/profiles.conf"
+
+// 加载预设参数组合，# 开头为注释
+func loadProfiles() map[string]url.Values {
+	profiles := make(map[string]url.Values)
+	data, err := readDataFile(profilesPath)
+	if err != nil {
+		return profiles
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, query, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		values, err := url.ParseQuery(strings.TrimSpace(query))
+		if err != nil {
+			Warn("HTTP", "profiles.conf 参数格式错误，忽略预设 %s: %v", strings.TrimSpace(name), err)
+			continue
+		}
+		profiles[strings.TrimSpace(name)] = values
+	}
+	return profiles
+}
+
+// 合并预设和请求参数：先取预设，再用请求中的同名参数覆盖
+func applyProfile(query url.Values) (url.Values, error) {
+	name := query.Get("profile")
+	if name == "" {
+		return query, nil
+	}
+	profile, ok := loadProfiles()[name]
+	if !ok {
+		return nil, fmt.Errorf("预设不存在: %s", name)
+	}
+	merged := url.Values{}
+	for k, v := range profile {
+		merged[k] = v
+	}
+	for k, v := range query {
+		if k != "profile" {
+			merged[k] = v
+		}
+	}
+	return merged, nil
+}
+
+// Surge 不支持的节点类型（仅用于检测和其他输出格式）
+var surgeUnsupported = map[string]bool{"vless": true}
+
+// Surge 不识别、仅供检测使用的参数，输出时移除
+var surgeIgnoredParams = map[string]bool{"congestion-controller": true}
+
+// 移除节点行中 Surge 不识别的参数
+func stripSurgeParams(line string) string {
+	parts := strings.Split(line, ",")
+	kept := parts[:0]
+	for _, p := range parts {
+		if k, _, ok := strings.Cut(strings.TrimSpace(p), "="); ok && surgeIgnoredParams[k] {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return strings.Join(kept, ",")
+}
+
+// 判断节点行能否输出到 Surge 配置
+func surgeSupported(line string) bool {
+	node, ok := parseNodeLine(line, "")
+	return !ok || !surgeUnsupported[node.Type]
+}
+
+// 按 iso、type 参数（逗号分隔，不区分大小写）筛选节点行，未设置的条件不筛选
+func matchFilter(line string, params map[string][]string) bool {
+	if isos := params["iso"]; len(isos) > 0 && !containsFold(isos, lineISO(line)) {
+		return false
+	}
+	if types := params["type"]; len(types) > 0 {
+		node, ok := parseNodeLine(line, "")
+		if !ok || !containsFold(types, node.Type) {
+			return false
+		}
+	}
+	return true
+}
+
+// 判断 v 是否在逗号分隔的列表中（不区分大小写）
+func containsFold(lists []string, v string) bool {
+	for _, list := range lists {
+		for _, item := range strings.Split(list, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 逐行处理 node.conf 并流式写出，定期 flush，内存占用与文件大小无关
+func streamNodes(w http.ResponseWriter, src io.Reader, params map[string][]string) {
+	flusher, _ := w.(http.Flusher)
+	bw := bufio.NewWriter(w)
+	scanner := newLineScanner(src)
+	count := 0
+	var sections []string // WireGuard 节点的 [WireGuard] 段，在所有代理行之后输出
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || !surgeSupported(line) || !matchFilter(line, params) {
+			continue
+		}
+		if proxy, section, ok := renderWireGuard(line, fmt.Sprintf("wg-%02d", len(sections)+1)); ok {
+			line = proxy
+			sections = append(sections, section)
+		}
+		if count > 0 {
+			bw.WriteString("\n")
+		}
+		bw.WriteString(processNode(stripSurgeParams(line), params))
+		count++
+		// 每 500 行推送一次，客户端尽早收到数据
+		if count%500 == 0 {
+			bw.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		Error("HTTP", "读取 node.conf 失败: %v", err)
+	}
+	for _, section := range sections {
+		bw.WriteString("\n\n" + section)
+	}
+	bw.Flush()
+}
+
+// 创建按行读取的 Scanner，放宽单行长度限制
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return scanner
+}
+
+// 处理 /conflux/fingerprint：返回当前节点集合的指纹，客户端可据此判断配置是否同步
+func handleFingerprint(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	if !validateToken(r) {
+		Warn("HTTP", "Token 校验失败: %s", requestToken(r))
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("invalid token"))
+		return
+	}
+
+	fingerprint, err := nodeConfFingerprint("/data/conflux/node.conf")
+	if err != nil {
+		Error("HTTP", "读取 node.conf 失败: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("read node.conf error"))
+		return
+	}
+
+	w.Header().Set("X-Conflux-Fingerprint", fingerprint)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(fingerprint))
+}
+
+// 处理 /conflux/nodes.csv：按 nodes.json 导出当前节点表（机场、名称、类型、服务器、端口、ISO、延迟毫秒）
+func handleNodesCSV(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	if !validateToken(r) {
+		Warn("HTTP", "Token 校验失败: %s", requestToken(r))
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("invalid token"))
+		return
+	}
+
+	nodes, err := loadNodesJSON()
+	if err != nil {
+		Error("HTTP", "读取 nodes.json 失败: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("read nodes.json error"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "nodes.csv"}))
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"airport", "name", "type", "server", "port", "iso", "latency_ms"})
+	for _, node := range nodes {
+		cw.Write([]string{csvCell(node.Source), csvCell(node.Name), csvCell(node.Type), csvCell(node.Server), csvCell(node.Port), csvCell(node.ISO),
+			strconv.FormatInt(node.Latency.Milliseconds(), 10)})
+	}
+	cw.Flush()
+}
+
+// csvCell 防止 CSV 公式注入：以 = + - @ 或制表符、回车开头的单元格前加 '，电子表格不再将其当作公式执行
+// 节点名等字段来自机场订阅，不可信
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// 处理 /conflux/status：返回版本、运行时长、更新状态和按机场/地区的节点数
+// 本进程尚未完成过更新时，最近更新时间取 node.conf 的修改时间，耗时为空
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	updateStateMu.Lock()
+	running := updateRunning > 0
+	lastStart, lastEnd, lastOK := lastUpdateStart, lastUpdateEnd, lastUpdateOK
+	updateStateMu.Unlock()
+
+	status := map[string]interface{}{
+		"version":  Version,
+		"uptime":   time.Since(startTime).Round(time.Second).String(),
+		"updating": running,
+	}
+	if !lastEnd.IsZero() {
+		status["last_update"] = lastEnd
+		status["last_update_duration"] = lastEnd.Sub(lastStart).Round(time.Millisecond).String()
+		status["last_update_ok"] = lastOK
+	} else if modTime, err := dataFileModTime("/data/conflux/node.conf"); err == nil {
+		status["last_update"] = modTime
+	}
+
+	// 地区分布与 conflux_region_nodes 同源，取自最近一次 egress 的统计
+	airports := map[string]int{}
+	nodes, err := loadNodesJSON()
+	if err != nil {
+		Warn("HTTP", "读取 nodes.json 失败: %v", err)
+	}
+	for _, node := range nodes {
+		airports[node.Source]++
+	}
+	status["nodes"] = len(nodes)
+	status["airports"] = airports
+	status["regions"] = currentRegions()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(status)
+}
+
+// 处理 /conflux/latency：返回当前节点的延迟历史统计（最小/平均/最大，毫秒）
+func handleLatency(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	nodes, err := loadNodesJSON()
+	if err != nil {
+		Error("HTTP", "读取 nodes.json 失败: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("read nodes.json error"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(summarizeLatency(nodes, loadMeta()))
+}
+
+// 处理 POST /conflux/token/rotate：轮换主 token，返回新 token 和旧 token 的宽限期
+func handleTokenRotate(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+		return
+	}
+	token, err := rotateToken("/data/conflux/token")
+	if err != nil {
+		Warn("TOKEN", "轮换 token 失败: %v", err)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token": token,
+		"grace": tokenGrace().String(),
+	})
+}
+
+// 处理 /conflux/sign：生成带有效期的签名链接，path 默认 /conflux，ttl 默认 24h
+// 签名只覆盖路径和有效期，其他查询参数（如 format、iso）可自由追加
+func handleSign(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	if os.Getenv("SIGN_SECRET") == "" {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("SIGN_SECRET not set"))
+		return
+	}
+	q := r.URL.Query()
+	path := q.Get("path")
+	if path == "" {
+		path = "/conflux"
+	}
+	ttl := 24 * time.Hour
+	if v := q.Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("invalid ttl"))
+			return
+		}
+		ttl = d
+	}
+	exp := time.Now().Add(ttl).Unix()
+	signed := fmt.Sprintf("%s%s?exp=%d&sig=%s", requestOrigin(r), path, exp, signPath(path, exp))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{"url": signed, "exp": exp})
+}
+
+// node.conf 摘要：内容哈希（用于 ETag）和节点集合指纹，按修改时间缓存
+// 写入 node.conf 后立即计算一次，请求时修改时间不变则直接复用，不再重复读取整个文件
+type confDigest struct {
+	path        string
+	modTime     time.Time
+	sum         string
+	fingerprint string
+}
+
+var (
+	digestMu     sync.Mutex
+	cachedDigest confDigest
+)
+
+// 读取 node.conf 摘要，修改时间与缓存一致时直接返回缓存
+func nodeConfDigest(path string) (confDigest, error) {
+	modTime, err := dataFileModTime(path)
+	if err != nil {
+		return confDigest{}, err
+	}
+	digestMu.Lock()
+	cached := cachedDigest
+	digestMu.Unlock()
+	if cached.path == path && cached.modTime.Equal(modTime) {
+		return cached, nil
+	}
+	return refreshNodeConfDigest(path)
+}
+
+// 重新计算 node.conf 摘要并缓存：一次读取同时计算内容哈希和指纹
+// 指纹按节点标识（类型+服务器+端口）排序后哈希，与行顺序和参数无关
+func refreshNodeConfDigest(path string) (confDigest, error) {
+	modTime, err := dataFileModTime(path)
+	if err != nil {
+		return confDigest{}, err
+	}
+	f, err := openDataFile(path)
+	if err != nil {
+		return confDigest{}, err
+	}
+	defer f.Close()
+
+	content := sha256.New()
+	var ids []string
+	scanner := newLineScanner(io.TeeReader(f, content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if node, ok := parseNodeLine(line, ""); ok {
+			ids = append(ids, stableID(node))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return confDigest{}, err
+	}
+	sort.Strings(ids)
+	idSum := sha256.Sum256([]byte(strings.Join(ids, "\n")))
+	d := confDigest{
+		path:        path,
+		modTime:     modTime,
+		sum:         hex.EncodeToString(content.Sum(nil)),
+		fingerprint: hex.EncodeToString(idSum[:])[:12],
+	}
+	digestMu.Lock()
+	cachedDigest = d
+	digestMu.Unlock()
+	return d, nil
+}
+
+// 计算节点集合指纹
+func nodeConfFingerprint(path string) (string, error) {
+	d, err := nodeConfDigest(path)
+	return d.fingerprint, err
+}
+
+// /conflux 响应的 Cache-Control max-age：CACHE_MAX_AGE（默认 5m），且不超过距下次定时更新的剩余时间
+// 强制更新随时可能发生，客户端依靠 ETag 重新验证，max-age 不宜过长
+func cacheMaxAge(nodeConf string) time.Duration {
+	maxAge := 5 * time.Minute
+	if d, err := time.ParseDuration(os.Getenv("CACHE_MAX_AGE")); err == nil && d >= 0 {
+		maxAge = d
+	}
+	if modTime, err := dataFileModTime(nodeConf); err == nil {
+		// 定时检查在 node.conf 超过 staleAfter 后的下一次检查时更新
+		if remaining := time.Until(modTime.Add(staleAfter)); remaining < maxAge {
+			maxAge = remaining
+		}
+	}
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	return maxAge
+}
+
+// 计算 /conflux 响应的 ETag：node.conf 内容哈希与查询参数共同决定输出
+func nodeConfETag(path, query string) (string, error) {
+	d, err := nodeConfDigest(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(d.sum + "\n" + query))
+	return `"` + hex.EncodeToString(sum[:])[:16] + `"`, nil
+}
+
+// 校验结果中的单个问题行
+type invalidLine struct {
+	Line  int    `json:"line"`
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// 处理 /validate：逐行校验 node.conf 能否被解析并转换为有效代理（不实际拨号）
+func handleValidate(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	if !validateToken(r) {
+		Warn("HTTP", "Token 校验失败: %s", requestToken(r))
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("invalid token"))
+		return
+	}
+
+	lines, err := loadNodeConf("/data/conflux/node.conf")
+	if err != nil {
+		Error("HTTP", "读取 node.conf 失败: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("read node.conf error"))
+		return
+	}
+
+	total := 0
+	invalid := []invalidLine{}
+	for i, line := range lines {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		total++
+		name, _, _ := strings.Cut(line, " = ")
+		if err := validateNodeLine(line); err != nil {
+			invalid = append(invalid, invalidLine{Line: i + 1, Name: strings.TrimSpace(name), Error: err.Error()})
+		}
+	}
+	Info("HTTP", "node.conf 校验完成: 总数=%d 无效=%d", total, len(invalid))
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"total":   total,
+		"invalid": invalid,
+	})
 }
 
 // 记录请求日志，包含完整URL和Header
@@ -72,6 +686,9 @@ func logRequest(r *http.Request) {
 	// 收集所有header信息
 	var headers []string
 	for k, v := range r.Header {
+		if k == "Authorization" {
+			v = []string{"***"} // 不记录凭据
+		}
 		headers = append(headers, fmt.Sprintf("%s: %s", k, strings.Join(v, ", ")))
 	}
 
@@ -81,83 +698,264 @@ func logRequest(r *http.Request) {
 	}
 }
 
+// 还原客户端请求的完整地址
+func requestURL(r *http.Request) string {
+	return requestOrigin(r) + r.URL.RequestURI()
+}
+
+// 还原客户端访问的协议和主机，反代时以 X-Forwarded-Proto / X-Forwarded-Host 为准
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	host := r.Host
+	if fwd := r.Header.Get("X-Forwarded-Host"); fwd != "" {
+		host = fwd
+	}
+	return scheme + "://" + host
+}
+
 // 设置 CORS 响应头
 func setCORSHeaders(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+	// 通配符不包含 Authorization，需单独列出
+	w.Header().Set("Access-Control-Allow-Headers", "*, Authorization")
+}
+
+// 管理接口鉴权中间件，用于 /conflux/config、/conflux/logs 等诊断接口
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !validateAdmin(r) {
+			Warn("HTTP", "管理接口鉴权失败: %s", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Basic realm="conflux"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("unauthorized"))
+			return
+		}
+		next(w, r)
+	}
 }
 
-// 校验 token 是否有效
+// 校验管理接口凭据：设置 ADMIN_USER/ADMIN_PASS 时使用 HTTP Basic 认证，
+// 未设置时回退到 token 校验（需要 admin 权限）
+func validateAdmin(r *http.Request) bool {
+	adminUser, adminPass := os.Getenv("ADMIN_USER"), os.Getenv("ADMIN_PASS")
+	if adminUser == "" || adminPass == "" {
+		return hasScope(r, ScopeAdmin)
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(adminUser)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(adminPass)) == 1
+	return userOK && passOK
+}
+
+// token 查询参数名，可通过 TOKEN_PARAM 配置，默认 t
+func tokenParam() string {
+	if name := os.Getenv("TOKEN_PARAM"); name != "" {
+		return name
+	}
+	return "t"
+}
+
+// 保留查询参数名（另见 paramMap 中的覆盖参数），TOKEN_PARAM、FORCE_PARAM 不能与之重名，否则会被当作筛选或格式参数处理
+var reservedParams = map[string]bool{
+	"format": true, "iso": true, "type": true, "profile": true, "exp": true, "sig": true,
+	"group-type": true, "group-by": true, "groups": true,
+}
+
+// 校验查询参数名：不能与保留参数重名，也不能与另一个参数名相同
+func checkParamName(env, name, other string) error {
+	if _, ok := paramMap[name]; ok || reservedParams[name] {
+		return fmt.Errorf("%s=%s 与保留参数重名", env, name)
+	}
+	if name == other {
+		return fmt.Errorf("%s=%s 与另一个查询参数名相同", env, name)
+	}
+	return nil
+}
+
+// 启动时校验 TOKEN_PARAM 和 FORCE_PARAM，冲突时退出，避免 token 或强制刷新参数被其他功能误用
+func checkQueryParams() {
+	for _, err := range []error{
+		checkParamName("TOKEN_PARAM", tokenParam(), forceParam()),
+		checkParamName("FORCE_PARAM", forceParam(), tokenParam()),
+	} {
+		if err != nil {
+			Error("HTTP", "查询参数名冲突: %v", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// 读取请求携带的 token：优先查询参数，其次 Authorization: Bearer 头（避免 token 出现在 URL 和代理日志中）
+func requestToken(r *http.Request) string {
+	if token := r.URL.Query().Get(tokenParam()); token != "" {
+		return token
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// token 权限：read 读取节点配置和诊断信息，update 触发强制更新，admin 访问管理接口（包含全部权限）
+const (
+	ScopeRead   = "read"
+	ScopeUpdate = "update"
+	ScopeAdmin  = "admin"
+)
+
+// 附加 token 列表路径：每行一个 token，格式 token = 权限列表（逗号分隔），如 friend-token = read
+const tokensPath = "/data/conflux/tokens.conf"
+
+// 加载附加 token 及其权限，# 开头为注释
+func loadScopedTokens() map[string]map[string]bool {
+	tokens := make(map[string]map[string]bool)
+	data, err := readDataFile(tokensPath)
+	if err != nil {
+		return tokens
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		token, scopes, ok := strings.Cut(line, "=")
+		if !ok || strings.TrimSpace(token) == "" {
+			continue
+		}
+		set := make(map[string]bool)
+		for _, scope := range strings.Split(scopes, ",") {
+			set[strings.TrimSpace(scope)] = true
+		}
+		tokens[strings.TrimSpace(token)] = set
+	}
+	return tokens
+}
+
+// 判断请求 token 是否具有指定权限：主 token（TOKEN 或 token 文件）具有全部权限，
+// tokens.conf 中的 token 按配置的权限，admin 包含全部权限
+func hasScope(r *http.Request, scope string) bool {
+	token := requestToken(r)
+	if token == "" {
+		// 签名链接只授予 read 权限；客户端证书按 CLIENT_CERT_SCOPES 授权
+		if verifiedClientCert(r) {
+			scopes := clientCertScopes()
+			return scopes[scope] || scopes[ScopeAdmin]
+		}
+		return scope == ScopeRead && validSignature(r)
+	}
+	if token == getToken("/data/conflux/token") || inTokenGrace(token) {
+		return true
+	}
+	scopes, ok := loadScopedTokens()[token]
+	return ok && (scopes[scope] || scopes[ScopeAdmin])
+}
+
+// 签名链接：?exp=<unix 时间戳>&sig=<HMAC-SHA256(SIGN_SECRET, 路径 + "\n" + exp) 的十六进制>
+// 未设置 SIGN_SECRET 时不启用
+func signPath(path string, exp int64) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("SIGN_SECRET")))
+	fmt.Fprintf(mac, "%s\n%d", path, exp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 校验签名链接：签名正确且未过期
+func validSignature(r *http.Request) bool {
+	if os.Getenv("SIGN_SECRET") == "" {
+		return false
+	}
+	q := r.URL.Query()
+	exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	return hmac.Equal([]byte(q.Get("sig")), []byte(signPath(r.URL.Path, exp)))
+}
+
+// 校验 token 是否有效（具有 read 权限）
 func validateToken(r *http.Request) bool {
-	token := r.URL.Query().Get("t")
-	return token != "" && token == getToken("/data/conflux/token")
+	return hasScope(r, ScopeRead)
+}
+
+// 强制更新查询参数名，可通过 FORCE_PARAM 配置，默认 f
+func forceParam() string {
+	if name := os.Getenv("FORCE_PARAM"); name != "" {
+		return name
+	}
+	return "f"
 }
 
 // 判断是否为强制更新请求
 func isForceUpdate(r *http.Request) bool {
-	_, ok := r.URL.Query()["f"]
+	_, ok := r.URL.Query()[forceParam()]
 	return ok
 }
 
 // 检查 node.conf 是否存在
 func nodeConfExists(path string) bool {
-	_, err := os.Stat(path)
+	_, err := dataFileModTime(path)
 	return err == nil
 }
 
 // 加载 node.conf 文件，返回节点行切片
 func loadNodeConf(path string) ([]string, error) {
-	data, err := os.ReadFile(path)
+	data, err := readDataFile(path)
 	if err != nil {
 		return nil, err
 	}
 	return strings.Split(string(data), "\n"), nil
 }
 
-// 处理节点参数覆盖和新增
-func processNodes(lines []string, params map[string][]string) []string {
-	// 定义允许的参数映射（URL参数名 -> 节点属性名）
-	paramMap := map[string]string{
-		"udp":  "udp-relay",
-		"quic": "block-quic",
-		"tfo":  "tfo",
-	}
+// 定义允许的参数映射（URL参数名 -> 节点属性名）
+var paramMap = map[string]string{
+	"udp":  "udp-relay",
+	"quic": "block-quic",
+	"tfo":  "tfo",
+}
 
-	var result []string
-	for _, line := range lines {
-		if line = strings.TrimSpace(line); line == "" {
-			continue
+// 处理单行节点的参数覆盖和新增
+func processNode(line string, params map[string][]string) string {
+	// 处理参数覆盖（只处理在paramMap中定义的参数）
+	for k, v := range params {
+		attr, ok := paramMap[k]
+		if !ok {
+			continue // 跳过未定义的参数
 		}
-
-		// 处理参数覆盖（只处理在paramMap中定义的参数）
-		for k, v := range params {
-			attr, ok := paramMap[k]
-			if !ok {
-				continue // 跳过未定义的参数
-			}
-			for _, val := range v {
-				line = replaceAttr(line, attr, val)
+		for _, val := range v {
+			if unsafeValue(val) {
+				continue // 跳过会破坏行格式的参数值
 			}
+			line = replaceAttr(line, attr, val)
 		}
+	}
 
-		// 处理参数新增（只处理在paramMap中定义的参数）
-		for k, v := range params {
-			attr, ok := paramMap[k]
-			if !ok {
-				continue // 跳过未定义的参数
+	// 处理参数新增（只处理在paramMap中定义的参数）
+	for k, v := range params {
+		attr, ok := paramMap[k]
+		if !ok {
+			continue // 跳过未定义的参数
+		}
+		for _, val := range v {
+			if unsafeValue(val) {
+				continue
 			}
-			for _, val := range v {
-				attrEq := attr + "="
-				if !strings.Contains(line, attrEq) {
-					// 直接在行尾添加逗号和参数
-					line += "," + attr + "=" + val
-				}
+			attrEq := attr + "="
+			if !strings.Contains(line, attrEq) {
+				// 直接在行尾添加逗号和参数
+				line += "," + attr + "=" + val
 			}
 		}
-		result = append(result, line)
 	}
-	return result
+	return line
 }
 
 // 替换节点属性值，仅替换等号后第一个逗号或行尾
@@ -174,3 +972,37 @@ func replaceAttr(line, attr, val string) string {
 	}
 	return line[:start] + val + line[start+end:]
 }
+
+// 处理 /healthz：进程存活即返回 200，无需鉴权
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok"))
+}
+
+// 处理 /readyz：node.conf 存在且非空，并且本进程最近一次更新成功时返回 200，否则 503，无需鉴权
+// 尚无可用 node.conf 且首次更新未完成时返回 starting，便于区分启动中与故障
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	updateStateMu.Lock()
+	finished, lastOK := !lastUpdateEnd.IsZero(), lastUpdateOK
+	updateStateMu.Unlock()
+
+	reason := ""
+	data, err := readDataFile("/data/conflux/node.conf")
+	switch {
+	case (err != nil || len(bytes.TrimSpace(data)) == 0) && !finished:
+		reason = "starting"
+	case err != nil:
+		reason = "node.conf not found"
+	case len(bytes.TrimSpace(data)) == 0:
+		reason = "node.conf is empty"
+	case finished && !lastOK:
+		reason = "last update failed"
+	}
+	if reason != "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(reason))
+		return
+	}
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// stats.go
+// 机场统计：每次更新后汇总各机场的拉取结果和节点统计，持久化到 stats.json，
+// 供 /conflux/stats 查询；本次拉取失败的机场保留上次成功拉取的时间。
+
+const statsPath = "/data/conflux/stats.json"
+
+// FetchResult 结构体：单个机场本次拉取的结果
+type FetchResult struct {
+	OK      bool
+	Latency time.Duration
+}
+
+// AirportStatus 结构体：单个机场的统计
+// Total: 本次解析出的节点数
+// Duplicated / Failed: 本次去重和检测失败的节点数
+// FailedBy: egress 检测失败按类型细分
+// Passed: 本次检测通过的节点数
+// Nodes: 当前 node.conf 中该机场的节点数（含沿用上次的节点；写入失败时保留上次的值）
+// Retained: 本次结果不可靠、沿用上次节点
+// LastSuccess: 最近一次拉取成功的时间
+type AirportStatus struct {
+	Total        int        `json:"total"`
+	Duplicated   int        `json:"duplicated"`
+	Failed       int        `json:"failed"`
+	FailedBy     FailedBy   `json:"failed_by"`
+	Passed       int        `json:"passed"`
+	Nodes        int        `json:"nodes"`
+	Retained     bool       `json:"retained"`
+	FetchOK      bool       `json:"fetch_ok"`
+	FetchLatency int64      `json:"fetch_latency_ms"`
+	LastFetch    time.Time  `json:"last_fetch"`
+	LastSuccess  *time.Time `json:"last_success,omitempty"`
+}
+
+// FailedBy 结构体：egress 检测失败按类型细分的节点数
+type FailedBy struct {
+	Connect int `json:"connect"`
+	Read    int `json:"read"`
+	Geo     int `json:"geo"`
+}
+
+// 读取机场统计，文件不存在或损坏时返回空表
+func loadAirportStats() map[string]*AirportStatus {
+	stats := make(map[string]*AirportStatus)
+	data, err := readDataFile(statsPath)
+	if err != nil {
+		return stats
+	}
+	if err := json.Unmarshal(data, &stats); err != nil {
+		Warn("UPDATE", "解析 stats.json 失败: %v", err)
+		return make(map[string]*AirportStatus)
+	}
+	return stats
+}
+
+// 汇总本次更新的机场统计并写入 stats.json；已从配置中移除的机场不再保留
+func saveAirportStats(ctx *UpdateContext, parsed []Node, fetches map[string]FetchResult) {
+	prev := loadAirportStats()
+	totals := make(map[string]int)
+	for _, node := range parsed {
+		totals[node.Source]++
+	}
+
+	stats := make(map[string]*AirportStatus)
+	for airport, fetch := range fetches {
+		s := &AirportStatus{
+			Total:        totals[airport],
+			Retained:     ctx.Retained[airport],
+			FetchOK:      fetch.OK,
+			FetchLatency: fetch.Latency.Milliseconds(),
+			LastFetch:    time.Now(),
+		}
+		if stat := ctx.AirportStats[airport]; stat != nil {
+			s.Duplicated, s.Failed, s.Passed = stat.Duplicated, stat.Failed, stat.Total
+			s.FailedBy = FailedBy{Connect: stat.ConnectFailed, Read: stat.ReadFailed, Geo: stat.GeoFailed}
+		}
+		if p := prev[airport]; p != nil {
+			s.LastSuccess = p.LastSuccess
+			s.Nodes = p.Nodes
+		}
+		if fetch.OK {
+			s.LastSuccess = &s.LastFetch
+		}
+		if ctx.Written != nil {
+			s.Nodes = ctx.Written[airport]
+		}
+		stats[airport] = s
+	}
+
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		Error("UPDATE", "序列化 stats.json 失败: %v", err)
+		return
+	}
+	if err := writeDataFile(statsPath, data); err != nil {
+		Error("UPDATE", "写入 stats.json 失败: %v", err)
+	}
+}
+
+// 处理 /conflux/stats：返回各机场的统计 JSON
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(loadAirportStats())
+}
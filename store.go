@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 内存模式：IN_MEMORY=1 或 /data 不可写时启用
+// node.conf、token、缓存等数据文件只保存在内存中，日志只输出到标准输出，适用于只读文件系统的无状态部署
+// 读取时优先使用内存中的内容，不存在时回退到磁盘（可由只读挂载提供初始 node.conf、tags.conf 等）
+
+type memFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+var (
+	memMu    sync.RWMutex
+	memOn    bool
+	memFiles = make(map[string]memFile)
+)
+
+// 是否处于内存模式
+func inMemory() bool {
+	memMu.RLock()
+	defer memMu.RUnlock()
+	return memOn
+}
+
+// 切换到内存模式
+func enableMemory(reason string) {
+	memMu.Lock()
+	already := memOn
+	memOn = true
+	memMu.Unlock()
+	if !already {
+		Warn("STORE", "启用内存模式（%s）：数据文件不再写入磁盘", reason)
+	}
+}
+
+// 检查数据目录是否可写：创建目录并尝试写入临时文件
+func dataDirWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+// 读取数据文件
+func readDataFile(path string) ([]byte, error) {
+	memMu.RLock()
+	f, ok := memFiles[path]
+	memMu.RUnlock()
+	if ok {
+		return append([]byte(nil), f.data...), nil
+	}
+	return os.ReadFile(path)
+}
+
+// 打开数据文件用于流式读取
+func openDataFile(path string) (io.ReadCloser, error) {
+	memMu.RLock()
+	f, ok := memFiles[path]
+	memMu.RUnlock()
+	if ok {
+		return io.NopCloser(bytes.NewReader(f.data)), nil
+	}
+	return os.Open(path)
+}
+
+// 获取数据文件修改时间
+func dataFileModTime(path string) (time.Time, error) {
+	memMu.RLock()
+	f, ok := memFiles[path]
+	memMu.RUnlock()
+	if ok {
+		return f.modTime, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// 写入数据文件：内存模式下只写内存；磁盘写入失败时自动切换到内存模式
+// 先写同目录临时文件再重命名，读取方不会看到写了一半的内容
+func writeDataFile(path string, data []byte) error {
+	if !inMemory() {
+		err := writeFileAtomic(path, data)
+		if err == nil {
+			return nil
+		}
+		Error("STORE", "写入 %s 失败: %v", filepath.Base(path), err)
+		enableMemory("写入失败")
+	}
+	memMu.Lock()
+	memFiles[path] = memFile{data: append([]byte(nil), data...), modTime: time.Now()}
+	memMu.Unlock()
+	return nil
+}
+
+// 原子写入文件：写入临时文件后重命名覆盖目标文件
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
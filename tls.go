@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tls.go
+// HTTPS：TLS_CERT/TLS_KEY 指定证书文件，或设置 ACME_DOMAIN 通过 Let's Encrypt 自动申请证书，
+// 避免 token 以明文在网络上传输；设置 CLIENT_CA 时要求客户端证书（mTLS）。
+
+// ACME 证书缓存目录
+const acmeCacheDir = "/data/conflux/acme"
+
+// 判断是否启用 HTTPS
+func tlsEnabled() bool {
+	return os.Getenv("ACME_DOMAIN") != "" || (os.Getenv("TLS_CERT") != "" && os.Getenv("TLS_KEY") != "")
+}
+
+// 创建 ACME 证书管理器：ACME_DOMAIN 为逗号分隔的域名，ACME_EMAIL 为可选的联系邮箱
+// 内存模式下不缓存证书，每次启动重新申请
+func acmeManager() *autocert.Manager {
+	var domains []string
+	for _, d := range strings.Split(os.Getenv("ACME_DOMAIN"), ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Email:      os.Getenv("ACME_EMAIL"),
+	}
+	if !inMemory() {
+		m.Cache = autocert.DirCache(acmeCacheDir)
+	}
+	return m
+}
+
+// 在 ACME_HTTP_ADDR（默认 :80）提供 HTTP-01 验证，其他请求重定向到 HTTPS
+// 监听失败时仍可通过 TLS-ALPN-01 在 HTTPS 端口完成验证，只记录警告
+func serveACMEChallenge(m *autocert.Manager) {
+	addr := os.Getenv("ACME_HTTP_ADDR")
+	if addr == "" {
+		addr = ":80"
+	}
+	if err := http.ListenAndServe(addr, m.HTTPHandler(nil)); err != nil {
+		Warn("HTTP", "ACME HTTP 验证服务启动失败 (%s): %v", addr, err)
+	}
+}
+
+// 设置 CLIENT_CA 时要求客户端出示由该 CA 签发的证书
+// ACME 的 TLS-ALPN-01 验证无法出示客户端证书，此时只能通过 HTTP-01 验证
+func applyClientCA(cfg *tls.Config) error {
+	caFile := os.Getenv("CLIENT_CA")
+	if caFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("CLIENT_CA 中没有有效的 PEM 证书")
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	Info("HTTP", "已启用客户端证书认证（CA: %s）", caFile)
+	return nil
+}
+
+// 判断请求是否出示了经 CLIENT_CA 校验的客户端证书
+func verifiedClientCert(r *http.Request) bool {
+	return os.Getenv("CLIENT_CA") != "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+// 客户端证书授予的权限 CLIENT_CERT_SCOPES（逗号分隔），默认 read
+func clientCertScopes() map[string]bool {
+	scopes := make(map[string]bool)
+	for _, scope := range strings.Split(firstNonEmpty(os.Getenv("CLIENT_CERT_SCOPES"), ScopeRead), ",") {
+		scopes[strings.TrimSpace(scope)] = true
+	}
+	return scopes
+}
+
+// 按配置启动 HTTP 或 HTTPS 服务
+func listenAndServe(srv *http.Server) error {
+	if os.Getenv("ACME_DOMAIN") != "" {
+		m := acmeManager()
+		srv.TLSConfig = m.TLSConfig()
+		if err := applyClientCA(srv.TLSConfig); err != nil {
+			return err
+		}
+		go serveACMEChallenge(m)
+		Info("HTTP", "启动 HTTPS 服务（ACME 自动证书: %s）... 监听地址 %s", os.Getenv("ACME_DOMAIN"), srv.Addr)
+		return srv.ListenAndServeTLS("", "")
+	}
+	if certFile, keyFile := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY"); certFile != "" && keyFile != "" {
+		srv.TLSConfig = &tls.Config{}
+		if err := applyClientCA(srv.TLSConfig); err != nil {
+			return err
+		}
+		Info("HTTP", "启动 HTTPS 服务... 监听地址 %s", srv.Addr)
+		return srv.ListenAndServeTLS(certFile, keyFile)
+	}
+	if os.Getenv("CLIENT_CA") != "" {
+		Warn("HTTP", "未启用 HTTPS，CLIENT_CA 不生效")
+	}
+	Info("HTTP", "启动 HTTP 服务... 监听地址 %s", srv.Addr)
+	return srv.ListenAndServe()
+}
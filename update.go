@@ -6,12 +6,20 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	neturl "net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -25,103 +33,367 @@ import (
 // Params: 节点次要参数（如 encrypt-method, password, tfo, udp-relay 等）
 // Source: 机场名
 // ISO/Emoji: 出口 geo/emoji
+// Tested: 出口检测成功的时间
+// Latency: 出口检测请求耗时
+// Name: 写入 node.conf 时生成的节点名
+// Tags: 来自配置的标签，原样贯穿 ingress/egress
+// CertCN/CertSANs/CertExpiry: TLS 节点证书信息（CERT_CHECK=1 时记录）
 // Failed: 是否在 ingress/egress 任一阶段失败
 
 type Node struct {
-	OriginName  string            // 原始节点名
-	Type        string            // 节点类型
-	Server      string            // 服务器地址
-	Port        string            // 端口
-	Params      map[string]string // 节点次要参数
-	ParamString string            // 原始参数字符串，保持顺序
-	Source      string            // 机场名
-	ISO         string            // geo
-	Emoji       string            // emoji
+	OriginName  string            `json:"origin_name"` // 原始节点名
+	Name        string            `json:"name"`        // 输出节点名
+	Type        string            `json:"type"`        // 节点类型
+	Server      string            `json:"server"`      // 服务器地址
+	Port        string            `json:"port"`        // 端口
+	Params      map[string]string `json:"params"`      // 节点次要参数
+	ParamString string            `json:"-"`           // 原始参数字符串，保持顺序
+	Source      string            `json:"source"`      // 机场名
+	ISO         string            `json:"iso"`         // geo
+	Emoji       string            `json:"emoji"`       // emoji
+	Tested      time.Time         `json:"tested"`      // 检测时间
+	Latency     time.Duration     `json:"latency"`     // 检测延迟（纳秒）
+	Tags        map[string]string `json:"tags,omitempty"`
+	CertCN      string            `json:"cert_cn,omitempty"`
+	CertSANs    []string          `json:"cert_sans,omitempty"`
+	CertExpiry  time.Time         `json:"cert_expiry,omitempty"`
 }
 
 // Stat 结构体：机场统计信息
 // Total: 总节点数
 // Duplicated: 去重节点数
 // Failed: ingress 或 egress 任一阶段失败的节点数
+// ConnectFailed/ReadFailed/GeoFailed: egress 检测失败按类型细分（无法连接、已连接但读取失败、出口信息无效）
 
 type Stat struct {
-	Total      int
-	Duplicated int
-	Failed     int
+	Total         int
+	Duplicated    int
+	Failed        int
+	ConnectFailed int
+	ReadFailed    int
+	GeoFailed     int
+}
+
+// countFailure 按丢弃原因累加 egress 检测失败类型计数，delta 为 -1 时撤销
+func (s *Stat) countFailure(reason string, delta int) {
+	switch reason {
+	case DropDial:
+		s.ConnectFailed += delta
+	case DropRead:
+		s.ReadFailed += delta
+	case DropGeo:
+		s.GeoFailed += delta
+	}
 }
 
 // UpdateContext 结构体：一次 update 流程的上下文
 // Nodes: 所有节点
 // AirportStats: 每个机场的统计信息
+// Retained: 本次结果不可靠、沿用上次 node.conf 中节点的机场
+// Meta: 按 StableID 记录的节点元数据
+// Dropped: 每个机场被丢弃的节点及原因
+// Regions: egress 过滤后存活节点的出口地区分布（ISO -> 节点数）
+// Written: 成功写入 node.conf 的每个机场节点数（含沿用上次的节点），未写入时为 nil
 
 type UpdateContext struct {
 	Nodes        []Node
 	AirportStats map[string]*Stat
+	Retained     map[string]bool
+	Meta         map[string]*NodeMeta
+	Dropped      map[string][]DropRecord
+	Regions      map[string]int
+	Written      map[string]int
+
+	mu sync.Mutex // 保护并发检测中对统计和丢弃记录的更新
+}
+
+// 节点丢弃原因
+const (
+	DropDuplicate = "duplicate" // 去重
+	DropDNS       = "dns"       // DNS 解析失败
+	DropDial      = "dial"      // 无法通过节点建立连接
+	DropRead      = "read"      // 已连接但读取超时或中断
+	DropGeo       = "geo"       // 出口检测失败
+	DropBlocked   = "blocked"   // 连续失败冷却期内跳过
+	DropUnsafe    = "unsafe"    // 参数含非法字符
+	DropCapped    = "capped"    // 超过机场裂变上限被截断
+	DropDeadline  = "deadline"  // 超过 egress 软截止时间未完成检测
+)
+
+// DropRecord 结构体：单个被丢弃节点的记录
+type DropRecord struct {
+	Name   string `json:"name"`
+	Server string `json:"server"`
+	Reason string `json:"reason"`
+}
+
+// dropNode 记录节点被丢弃的原因（并发安全）
+func (ctx *UpdateContext) dropNode(n Node, reason string) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.Dropped[n.Source] = append(ctx.Dropped[n.Source], DropRecord{
+		Name:   n.OriginName,
+		Server: n.Server,
+		Reason: reason,
+	})
+	if stat := ctx.AirportStats[n.Source]; stat != nil {
+		stat.countFailure(reason, 1)
+	}
+}
+
+// restoreNode 撤销节点最近一次丢弃记录和失败计数（如宽限期内保留的节点）
+func (ctx *UpdateContext) restoreNode(n Node) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	records := ctx.Dropped[n.Source]
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Name == n.OriginName && records[i].Server == n.Server {
+			reason := records[i].Reason
+			ctx.Dropped[n.Source] = append(records[:i], records[i+1:]...)
+			if stat := ctx.AirportStats[n.Source]; stat != nil && stat.Failed > 0 {
+				stat.Failed--
+				stat.countFailure(reason, -1)
+			}
+			return
+		}
+	}
+}
+
+// 更新状态：是否正在更新以及最近一次更新的起止时间和结果，供 /conflux/status、/readyz 查询
+var (
+	updateStateMu   sync.Mutex
+	updateRunning   int
+	lastUpdateStart time.Time
+	lastUpdateEnd   time.Time
+	lastUpdateOK    bool
+)
+
+// 记录更新开始，返回结束时调用的函数（参数为是否成功写入 node.conf）
+func trackUpdate() func(ok bool) {
+	updateStateMu.Lock()
+	updateRunning++
+	start := time.Now()
+	updateStateMu.Unlock()
+	return func(ok bool) {
+		updateStateMu.Lock()
+		defer updateStateMu.Unlock()
+		updateRunning--
+		lastUpdateStart, lastUpdateEnd, lastUpdateOK = start, time.Now(), ok
+		recordUpdateMetrics(lastUpdateStart, lastUpdateEnd, ok)
+		Info("UPDATE", "更新完成，耗时 %s", lastUpdateEnd.Sub(start).Round(time.Millisecond))
+	}
 }
 
-// updateNodes 是节点聚合与更新的主流程，串联各阶段
-func updateNodes() {
-	// 1. 解析 SUB 环境变量，获取机场名和订阅链接
-	subEnv := os.Getenv("SUB")
-	airports := parseSubEnv(subEnv)
+// updateNodes 是节点聚合与更新的主流程，串联各阶段，返回是否成功写入 node.conf
+// 通过 startUpdateJob 调用，保证同一时间只有一次更新
+func updateNodes() bool {
+	finish := trackUpdate()
+
+	// 0. 补传上次未成功上传的 node.conf，保证 Gists 最终与本地一致
+	retryPendingGists()
+
+	// 1. 解析 SUB 环境变量和 SUB_FILE 文件，获取机场名和订阅链接
+	airports := loadAirports()
 
 	// 2. 并发拉取所有机场订阅内容
-	rawProxies := fetchAllProxies(airports)
+	jobStage(StageFetch)
+	rawProxies, fetches := fetchAllProxies(airports)
+	fetched := 0
+	for _, lines := range rawProxies {
+		if lines != nil {
+			fetched++
+		}
+	}
+	jobStageCount(fetched)
 
 	// 3. 解析节点，过滤无效行，生成 Node 列表
+	jobStage(StageIngress)
 	nodes := parseAllNodes(rawProxies)
 
 	// 4. 创建上下文，初始化机场统计
 	ctx := &UpdateContext{
 		Nodes:        nodes,
 		AirportStats: make(map[string]*Stat),
+		Retained:     make(map[string]bool),
+		Meta:         loadMeta(),
+		Dropped:      make(map[string][]DropRecord),
+	}
+
+	// 4.1 订阅返回 200 但内容为空时视为软失败，沿用上次节点；EMPTY_SUB=clear 时视为机场已无节点
+	if os.Getenv("EMPTY_SUB") != "clear" {
+		for airport, lines := range rawProxies {
+			if lines != nil && strings.TrimSpace(strings.Join(lines, "")) == "" {
+				Warn("UPDATE", "[%s] 订阅内容为空，沿用上次节点", airport)
+				ctx.Retained[airport] = true
+			}
+		}
 	}
 
 	// 5. ingress 入口处理（DNS 裂变、SNI 补全、失败统计）
 	ingress(ctx)
+	jobStageCount(len(ctx.Nodes))
 
-	// 6. egress 出口检测（geo 检测、失败统计）
+	// 6. egress 出口检测（geo 检测、失败统计），并保存节点元数据
+	jobStage(StageEgress)
 	egress(ctx)
+	saveMeta(ctx.Meta)
+	recordNodeMetrics(nodes, ctx)
 
-	// 7. 写入 node.conf
-	writeNodeConf(ctx.Nodes)
+	// 6.1 按节点名去重（可选，需在 egress 之后以便按延迟择优）
+	if os.Getenv("DEDUP_BY_NAME") == "1" {
+		dedupByName(ctx)
+	}
+	jobStageCount(len(ctx.Nodes))
 
+	// 7. 写入 node.conf 和丢弃明细
+	jobStage(StageWrite)
+	ok := writeNodeConf(ctx)
+	writeDropped(ctx.Dropped)
+	saveAirportStats(ctx, nodes, fetches)
+	finish(ok)
+	return ok
 }
 
-// 解析 SUB 环境变量，返回 map[机场名]订阅链接
-func parseSubEnv(sub string) map[string]string {
+// 解析 SUB 环境变量，返回 map[机场名]订阅链接；source 为配置来源（SUB 或文件路径），用于警告日志
+// 同一来源内的同名机场同样以先出现的为准
+func parseSubEnv(sub, source string) map[string]string {
 	result := make(map[string]string)
 	for _, part := range strings.Split(sub, "||") {
 		kv := strings.SplitN(part, "=", 2)
-		if len(kv) == 2 {
-			result[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		if len(kv) != 2 {
+			continue
 		}
+		name, url := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if existing, ok := result[name]; ok {
+			if existing != url {
+				Warn("UPDATE", "[%s] 机场重复定义，忽略 %s 中的配置", name, source)
+			}
+			continue
+		}
+		result[name] = url
 	}
 	return result
 }
 
-// 并发拉取所有机场订阅内容，返回 map[机场名][]原始行
-func fetchAllProxies(airports map[string]string) map[string][]string {
+// 加载机场列表：先读取 SUB 环境变量，再按顺序合并 SUB_FILE 中的文件
+// 同名机场以先出现的为准，后出现的冲突定义会被忽略并记录警告
+func loadAirports() map[string]string {
+	airports := parseSubEnv(os.Getenv("SUB"), "SUB")
+	for _, path := range subFiles(os.Getenv("SUB_FILE")) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			Error("UPDATE", "读取订阅文件失败: %s: %v", path, err)
+			continue
+		}
+		// 文件内容支持每行一个或以 || 分隔多个机场，# 开头为注释
+		var parts []string
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				parts = append(parts, line)
+			}
+		}
+		for name, url := range parseSubEnv(strings.Join(parts, "||"), path) {
+			if existing, ok := airports[name]; ok {
+				if existing != url {
+					Warn("UPDATE", "[%s] 机场重复定义，忽略 %s 中的配置", name, path)
+				}
+				continue
+			}
+			airports[name] = url
+		}
+	}
+	return airports
+}
+
+// 展开 SUB_FILE：逗号分隔的文件列表，目录则读取其中的 *.conf（按文件名排序）
+func subFiles(subFile string) []string {
+	var files []string
+	for _, path := range strings.Split(subFile, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			matches, _ := filepath.Glob(filepath.Join(path, "*.conf"))
+			sort.Strings(matches)
+			files = append(files, matches...)
+			continue
+		}
+		files = append(files, path)
+	}
+	return files
+}
+
+// 并发拉取所有机场订阅内容，返回 map[机场名][]原始行和每个机场的拉取结果
+func fetchAllProxies(airports map[string]string) (map[string][]string, map[string]FetchResult) {
 	result := make(map[string][]string)
+	fetches := make(map[string]FetchResult)
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 	for name, url := range airports {
 		wg.Add(1)
 		go func(name, url string) {
 			defer wg.Done()
+			start := time.Now()
 			lines := fetchProxies(name, url)
+			latency := time.Since(start)
+			if lines != nil {
+				fetchTotal.add(1, name, "success")
+			} else {
+				fetchTotal.add(1, name, "failure")
+			}
+			publishEvent("fetch", map[string]interface{}{"airport": name, "ok": lines != nil, "lines": len(lines)})
 			mu.Lock()
 			result[name] = lines
+			fetches[name] = FetchResult{OK: lines != nil, Latency: latency}
 			mu.Unlock()
 		}(name, url)
 	}
 	wg.Wait()
-	return result
+	return result, fetches
 }
 
 // 拉取单个机场订阅，返回所有行（失败重试一次，UA 伪装为 Surge）
-func fetchProxies(airport, url string) []string {
-	client := &http.Client{Timeout: 10 * time.Second}
+// 订阅链接可用 | 分隔多个备用链接，按顺序尝试，前一个重试失败后使用下一个
+func fetchProxies(airport, spec string) []string {
+	urls, proxy := splitAirportProxy(spec)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = newDialer().DialContext
+	// 拉取代理优先级：机场单独配置 > FETCH_PROXY > 直连
+	if proxy == "" {
+		proxy = os.Getenv("FETCH_PROXY")
+	}
+	if proxy != "" {
+		proxyURL, err := neturl.Parse(proxy)
+		if err != nil {
+			Error("UPDATE", "[%s] 拉取代理格式错误: %v", airport, err)
+			return nil
+		}
+		Info("UPDATE", "[%s] 通过代理拉取: %s", airport, proxyURL.Redacted())
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	client := &http.Client{Timeout: 10 * time.Second, Transport: transport}
+	mirrors := strings.Split(urls, "|")
+	for i, url := range mirrors {
+		url = strings.TrimSpace(url)
+		if lines, ok := fetchURL(client, airport, url); ok {
+			if len(mirrors) > 1 {
+				Info("UPDATE", "[%s] 使用订阅链接 %d/%d 拉取成功: %s", airport, i+1, len(mirrors), urlHost(url))
+			}
+			return lines
+		}
+		if i+1 < len(mirrors) {
+			Warn("UPDATE", "[%s] 订阅链接 %d/%d 拉取失败，尝试备用链接", airport, i+1, len(mirrors))
+		}
+	}
+	return nil
+}
+
+// 拉取单个订阅链接，返回所有行和是否成功；直接配置的代理链接（如 ss://）作为单行内容返回
+func fetchURL(client *http.Client, airport, url string) ([]string, bool) {
+	if isProxyURI(url) {
+		Info("UPDATE", "[%s] 使用直接配置的 %s 链接", airport, uriScheme(url))
+		return []string{url}, true
+	}
 	for i := 0; i < 2; i++ {
 		req, err := http.NewRequest("GET", url, nil)
 		if err != nil {
@@ -147,36 +419,281 @@ func fetchProxies(airport, url string) []string {
 		}
 		defer resp.Body.Close()
 		scanner := bufio.NewScanner(resp.Body)
-		var lines []string
+		lines := []string{} // 非 nil，与拉取失败区分
 		for scanner.Scan() {
 			lines = append(lines, scanner.Text())
 		}
 		if len(lines) == 0 {
 			Warn("UPDATE", "[%s] 返回空内容", airport)
 		} else {
-			nodeCount := len(extractProxyLines(lines))
+			nodeCount := len(parseSubscription(airport, lines))
 			Info("UPDATE", "[%s] 原始节点数: %d", airport, nodeCount)
 		}
-		return lines
+		return lines, true
 	}
 	Error("UPDATE", "[%s] 重试失败", airport)
-	return nil
+	return nil, false
+}
+
+// 订阅链接的主机名，用于日志（不输出路径和查询参数中的订阅 token）
+func urlHost(url string) string {
+	if u, err := neturl.Parse(url); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return "?"
+}
+
+// 拆分机场配置中的订阅链接和拉取代理，格式：订阅链接=proxy:socks5://host:port
+func splitAirportProxy(spec string) (string, string) {
+	if idx := strings.LastIndex(spec, "=proxy:"); idx != -1 {
+		return spec[:idx], spec[idx+len("=proxy:"):]
+	}
+	return spec, ""
 }
 
 // 解析所有机场的节点，过滤无效行，返回 Node 列表
+// 节点参数按层合并，优先级：节点自身参数 > 机场参数（AIRPORT_PARAMS）> 全局默认（DEFAULT_PARAMS）
 func parseAllNodes(rawProxies map[string][]string) []Node {
+	defaults := parseParamList(os.Getenv("DEFAULT_PARAMS"))
+	airportParams := parseAirportParams(os.Getenv("AIRPORT_PARAMS"))
+	airportTags := loadTags()
+	rewrites := parseServerRewrite(os.Getenv("SERVER_REWRITE"))
+
 	nodes := []Node{}
 	for airport, lines := range rawProxies {
-		for _, line := range extractProxyLines(lines) {
-			node, ok := parseNodeLine(line, airport)
-			if ok {
+		layered := make(map[string]string)
+		for k, v := range defaults {
+			layered[k] = v
+		}
+		for k, v := range airportParams[airport] {
+			layered[k] = v
+		}
+		for _, node := range parseSubscription(airport, lines) {
+			for k, v := range layered {
+				if _, exists := node.Params[k]; !exists {
+					node.Params[k] = v
+				}
+			}
+			if tags := airportTags[airport]; len(tags) > 0 {
+				node.Tags = tags
+			}
+			if server := rewriteServer(node.Server, rewrites); server != node.Server {
+				Debug("UPDATE", "[%s] %s: 服务器改写 %s -> %s", airport, node.OriginName, node.Server, server)
+				node.Server = server
+			}
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// 服务器改写规则：后缀匹配或正则匹配后替换为规范主机名
+type serverRewrite struct {
+	suffix    string
+	re        *regexp.Regexp
+	canonical string
+}
+
+// 解析 SERVER_REWRITE，格式：后缀=>规范主机名||re:正则=>替换（支持 $1 引用）
+// 用于把机场轮换的 CNAME 主机名归一，使同一服务稳定去重
+func parseServerRewrite(s string) []serverRewrite {
+	var rules []serverRewrite
+	for _, part := range strings.Split(s, "||") {
+		pattern, canonical, ok := strings.Cut(strings.TrimSpace(part), "=>")
+		if !ok || pattern == "" || canonical == "" {
+			continue
+		}
+		if expr, isRegexp := strings.CutPrefix(pattern, "re:"); isRegexp {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				Warn("UPDATE", "SERVER_REWRITE 正则无效，忽略: %s: %v", expr, err)
+				continue
+			}
+			rules = append(rules, serverRewrite{re: re, canonical: canonical})
+			continue
+		}
+		rules = append(rules, serverRewrite{suffix: strings.ToLower(pattern), canonical: canonical})
+	}
+	return rules
+}
+
+// 按顺序应用第一条匹配的改写规则，IP 地址不改写
+func rewriteServer(server string, rules []serverRewrite) string {
+	if isIP(server) {
+		return server
+	}
+	for _, rule := range rules {
+		if rule.re != nil {
+			if rule.re.MatchString(server) {
+				return rule.re.ReplaceAllString(server, rule.canonical)
+			}
+		} else if strings.HasSuffix(strings.ToLower(server), rule.suffix) {
+			return rule.canonical
+		}
+	}
+	return server
+}
+
+// 按订阅格式解析单个机场的节点：SIP008 JSON、sing-box JSON、Clash YAML、代理链接列表（V2RayN base64 或明文）或 Surge [Proxy] 块
+func parseSubscription(airport string, lines []string) []Node {
+	if nodes, ok := parseSIP008(airport, lines); ok {
+		return nodes
+	}
+	if nodes, ok := parseSingBox(airport, lines); ok {
+		return nodes
+	}
+	if nodes, ok := parseClash(airport, lines); ok {
+		return nodes
+	}
+	if nodes, ok := parseV2RayN(airport, lines); ok {
+		return nodes
+	}
+	var nodes []Node
+	sections := extractWireGuardSections(lines)
+	for _, line := range extractProxyLines(lines) {
+		if node, isWireGuard, err := parseWireGuardLine(line, airport, sections); isWireGuard {
+			if err != nil {
+				Warn("UPDATE", "[%s] WireGuard 节点无法解析，跳过: %v", airport, err)
+			} else {
 				nodes = append(nodes, node)
 			}
+			continue
+		}
+		if node, ok := parseNodeLine(line, airport); ok {
+			nodes = append(nodes, node)
 		}
 	}
 	return nodes
 }
 
+// SIP008 订阅中的单个服务器
+type sip008Server struct {
+	ID         string `json:"id"`
+	Remarks    string `json:"remarks"`
+	Server     string `json:"server"`
+	ServerPort int    `json:"server_port"`
+	Password   string `json:"password"`
+	Method     string `json:"method"`
+	Plugin     string `json:"plugin"`
+	PluginOpts string `json:"plugin_opts"`
+}
+
+// 解析 SIP008 JSON 订阅（{"version":1,"servers":[...]}），非 SIP008 格式时返回 false
+func parseSIP008(airport string, lines []string) ([]Node, bool) {
+	content := strings.TrimSpace(strings.Join(lines, "\n"))
+	if !strings.HasPrefix(content, "{") {
+		return nil, false
+	}
+	var doc struct {
+		Servers []sip008Server `json:"servers"`
+	}
+	if err := json.Unmarshal([]byte(content), &doc); err != nil || doc.Servers == nil {
+		return nil, false
+	}
+
+	nodes := []Node{}
+	for _, srv := range doc.Servers {
+		name := srv.Remarks
+		if name == "" {
+			name = srv.ID
+		}
+		if name == "" {
+			name = fmt.Sprintf("%s:%d", srv.Server, srv.ServerPort)
+		}
+		if srv.Server == "" || srv.ServerPort == 0 || srv.Method == "" {
+			Warn("UPDATE", "[%s] SIP008 节点缺少必要字段，跳过: %s", airport, name)
+			continue
+		}
+		params := []string{"encrypt-method=" + srv.Method, "password=" + srv.Password}
+		switch srv.Plugin {
+		case "":
+		case "obfs-local", "simple-obfs":
+			// plugin_opts 格式：obfs=http;obfs-host=example.com
+			for _, opt := range strings.Split(srv.PluginOpts, ";") {
+				if k, v, ok := strings.Cut(strings.TrimSpace(opt), "="); ok && (k == "obfs" || k == "obfs-host") {
+					params = append(params, k+"="+v)
+				}
+			}
+		default:
+			Warn("UPDATE", "[%s] SIP008 节点插件不受支持，跳过: %s (%s)", airport, name, srv.Plugin)
+			continue
+		}
+		nodes = append(nodes, newNode(name, "ss", srv.Server, strconv.Itoa(srv.ServerPort), airport, params))
+	}
+	return nodes, true
+}
+
+// 由有序参数（key=value）构造 Node，供非 Surge 格式的订阅解析使用
+func newNode(name, typ, server, port, airport string, params []string) Node {
+	paramMap := make(map[string]string)
+	for _, p := range params {
+		if k, v, ok := strings.Cut(p, "="); ok {
+			paramMap[k] = v
+		}
+	}
+	return Node{
+		OriginName:  name,
+		Type:        typ,
+		Server:      server,
+		Port:        port,
+		Params:      paramMap,
+		ParamString: strings.Join(params, ","),
+		Source:      airport,
+	}
+}
+
+// 加载机场标签：TAGS 环境变量与 /data/conflux/tags.conf（每行一个机场），格式均为 机场A:tier=premium,notes=streaming
+// 同一机场的同名标签以环境变量为准
+func loadTags() map[string]map[string]string {
+	tags := parseAirportParams(os.Getenv("TAGS"))
+	data, err := readDataFile("/data/conflux/tags.conf")
+	if err != nil {
+		return tags
+	}
+	var parts []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			parts = append(parts, line)
+		}
+	}
+	for airport, fileTags := range parseAirportParams(strings.Join(parts, "||")) {
+		if tags[airport] == nil {
+			tags[airport] = make(map[string]string)
+		}
+		for k, v := range fileTags {
+			if _, exists := tags[airport][k]; !exists {
+				tags[airport][k] = v
+			}
+		}
+	}
+	return tags
+}
+
+// 解析参数列表，格式：key=value,key2=value2
+func parseParamList(s string) map[string]string {
+	result := make(map[string]string)
+	for _, p := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 && kv[0] != "" {
+			result[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return result
+}
+
+// 解析按机场划分的参数，格式：机场A:key=value,key2=value2||机场B:key=value
+func parseAirportParams(s string) map[string]map[string]string {
+	result := make(map[string]map[string]string)
+	for _, part := range strings.Split(s, "||") {
+		name, params, ok := strings.Cut(part, ":")
+		if !ok {
+			continue
+		}
+		result[strings.TrimSpace(name)] = parseParamList(params)
+	}
+	return result
+}
+
 // 提取 [Proxy] 块的节点行，过滤注释、reject、direct
 func extractProxyLines(lines []string) []string {
 	var result []string
@@ -254,25 +771,167 @@ func formatNode(n Node, newName string) string {
 		}
 	}
 
-	// 添加新增的参数到末尾
-	for k, v := range n.Params {
+	// 添加新增的参数到末尾，按参数名排序保证输出稳定
+	var added []string
+	for k := range n.Params {
 		if !originalParams[k] {
-			if params != "" {
-				params += ","
+			added = append(added, k)
+		}
+	}
+	sort.Strings(added)
+	for _, k := range added {
+		if params != "" {
+			params += ","
+		}
+		params += k + "=" + n.Params[k]
+	}
+
+	// 按 PARAM_WHITELIST / PARAM_BLACKLIST 过滤参数
+	params = filterParams(params)
+
+	// CANONICAL_PARAMS=1 时按固定顺序排列参数，便于跨机场比较
+	if os.Getenv("CANONICAL_PARAMS") == "1" {
+		params = canonicalParams(params)
+	}
+
+	// SHOW_TESTED=1 时追加检测时间，便于客户端判断节点新鲜度
+	if os.Getenv("SHOW_TESTED") == "1" && !n.Tested.IsZero() {
+		if params != "" {
+			params += ","
+		}
+		params += fmt.Sprintf("tested=%d", n.Tested.Unix())
+	}
+
+	// 没有参数时不输出分隔符，避免行尾多出逗号
+	line := fmt.Sprintf("%s = %s,%s,%s", newName, n.Type, n.Server, n.Port)
+	if params != "" {
+		line += ", " + params
+	}
+	return line
+}
+
+// 检查节点字段能否安全写入 Surge 行：参数名不能含 = , 或空白，参数值、服务器和端口不能含逗号或换行
+// 参数值中的 = 是合法的（如 base64 密码），Surge 只按第一个 = 切分
+func checkNodeFields(n *Node) error {
+	if unsafeValue(n.Server) || unsafeValue(n.Port) {
+		return fmt.Errorf("服务器或端口含非法字符")
+	}
+	for k, v := range n.Params {
+		if k == "" || strings.ContainsAny(k, "=, \t\r\n") {
+			return fmt.Errorf("参数名非法: %q", k)
+		}
+		if unsafeValue(v) {
+			return fmt.Errorf("参数 %s 的值含非法字符: %q", k, v)
+		}
+	}
+	return nil
+}
+
+// 判断值是否含有会破坏 Surge 行格式的字符（逗号、换行）
+func unsafeValue(v string) bool {
+	return strings.ContainsAny(v, ",\r\n")
+}
+
+// 规范参数顺序中排在最前的参数，其余参数按名称字母序排在其后
+var canonicalOrder = []string{"encrypt-method", "password", "username", "psk", "version"}
+
+// 将参数字符串重排为规范顺序
+func canonicalParams(params string) string {
+	rank := make(map[string]int)
+	for i, k := range canonicalOrder {
+		rank[k] = i + 1
+	}
+	var entries []string
+	for _, p := range strings.Split(params, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			entries = append(entries, p)
+		}
+	}
+	key := func(entry string) string {
+		k, _, _ := strings.Cut(entry, "=")
+		return k
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		ki, kj := key(entries[i]), key(entries[j])
+		ri, rj := rank[ki], rank[kj]
+		switch {
+		case ri > 0 && rj > 0:
+			return ri < rj
+		case ri > 0 || rj > 0:
+			return ri > 0
+		default:
+			return ki < kj
+		}
+	})
+	return strings.Join(entries, ",")
+}
+
+// 节点可用所必需的参数，不受 PARAM_WHITELIST / PARAM_BLACKLIST 影响
+var essentialParams = map[string]bool{
+	"encrypt-method": true,
+	"password":       true,
+	"username":       true,
+	"uuid":           true,
+	"token":          true,
+	"psk":            true,
+	"version":        true,
+	// shadow-tls 子参数缺一不可，单独丢弃任一项都会导致节点不可用
+	"shadow-tls-password": true,
+	"shadow-tls-sni":      true,
+	"shadow-tls-version":  true,
+}
+
+// 过滤参数字符串：设置 PARAM_WHITELIST 时仅保留名单内参数，PARAM_BLACKLIST 中的参数被移除
+// 必需参数始终保留
+func filterParams(params string) string {
+	whitelist := parseNameList(os.Getenv("PARAM_WHITELIST"))
+	blacklist := parseNameList(os.Getenv("PARAM_BLACKLIST"))
+	if len(whitelist) == 0 && len(blacklist) == 0 {
+		return params
+	}
+	var kept []string
+	for _, p := range strings.Split(params, ",") {
+		k, _, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if k == "" {
+			continue
+		}
+		if !essentialParams[k] {
+			if len(whitelist) > 0 && !whitelist[k] {
+				continue
+			}
+			if blacklist[k] {
+				continue
 			}
-			params += k + "=" + v
 		}
+		kept = append(kept, strings.TrimSpace(p))
 	}
+	return strings.Join(kept, ",")
+}
 
-	return fmt.Sprintf("%s = %s,%s,%s, %s", newName, n.Type, n.Server, n.Port, params)
+// 解析逗号分隔的名称列表
+func parseNameList(s string) map[string]bool {
+	result := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			result[name] = true
+		}
+	}
+	return result
 }
 
-// 写入 node.conf 文件
-func writeNodeConf(nodes []Node) {
+// 写入 node.conf 文件，返回是否成功写入
+func writeNodeConf(ctx *UpdateContext) bool {
+	nodes := ctx.Nodes
 	// 1. 按 Source+ISO 分组
 	groupMap := make(map[string][]*Node)
 	for i := range nodes {
 		node := &nodes[i]
+		// 参数中含有会破坏 Surge 行格式的字符时丢弃节点，避免输出损坏或注入额外参数
+		if err := checkNodeFields(node); err != nil {
+			Warn("UPDATE", "[%s] %s: %v，丢弃节点", node.Source, node.OriginName, err)
+			ctx.dropNode(*node, DropUnsafe)
+			continue
+		}
 		groupKey := fmt.Sprintf("%s|%s", node.Source, node.ISO)
 		groupMap[groupKey] = append(groupMap[groupKey], node)
 	}
@@ -284,48 +943,285 @@ func writeNodeConf(nodes []Node) {
 	}
 	sort.Strings(groupKeys)
 
+	// 沿用上次 node.conf 中被保留机场的节点（已是最终格式），其名称先登记，避免与新节点重名
+	prevLines := previousLines(ctx.Retained)
+	usedNames := make(map[string]bool)
+	for _, line := range prevLines {
+		if name, _, ok := strings.Cut(line, " = "); ok {
+			usedNames[strings.TrimSpace(name)] = true
+		}
+	}
+
 	lines := []string{}
+	written := []Node{}
+	suffixTags := strings.Split(os.Getenv("TAG_SUFFIX"), ",")
 	for _, groupKey := range groupKeys {
 		group := groupMap[groupKey]
 		// 组内顺序保持原始顺序，编号递增
 		for j, node := range group {
 			newName := fmt.Sprintf("%s [%s%s]-%02d", node.Source, node.ISO, node.Emoji, j+1)
+			// TAG_SUFFIX 中列出的标签值追加到节点名末尾
+			for _, key := range suffixTags {
+				if v := node.Tags[strings.TrimSpace(key)]; v != "" {
+					newName += " " + v
+				}
+			}
+			// 生成的名称重复时追加序号区分，保证 node.conf 中每行名称唯一
+			if usedNames[newName] {
+				base := newName
+				for k := 2; usedNames[newName]; k++ {
+					newName = fmt.Sprintf("%s #%d", base, k)
+				}
+				Warn("UPDATE", "[%s] 节点名重复: %s，重命名为 %s", node.Source, base, newName)
+			}
+			usedNames[newName] = true
+			node.Name = newName
 			line := formatNode(*node, newName)
 			lines = append(lines, line)
+			written = append(written, *node)
 		}
 	}
 
+	lines = append(lines, prevLines...)
+	written = append(written, previousNodes(ctx.Retained)...)
+
 	// 3. 最后统一替换 true/false 为 1/0
 	content := strings.Join(lines, "\n")
 	content = strings.ReplaceAll(content, "=true", "=1")
 	content = strings.ReplaceAll(content, "=false", "=0")
+	content = runPostHook(content)
 
 	// 4. 检查内容非空再写入，并支持 Gists 上传
-	if strings.TrimSpace(content) != "" {
-		nodeConfPath := "/data/conflux/node.conf"
-		if err := os.WriteFile(nodeConfPath, []byte(content), 0644); err != nil {
-			Error("UPDATE", "写入 node.conf 失败: %v", err)
-		} else {
-			Info("UPDATE", "成功写入 node.conf: %s (%d 行)", nodeConfPath, len(lines))
-			gistsEnv := os.Getenv("GISTS")
-			if gistsEnv != "" {
-				uploadToGists(gistsEnv, nodeConfPath)
-			}
-		}
-	} else {
+	if strings.TrimSpace(content) == "" {
 		Warn("UPDATE", "node.conf 内容为空，跳过写入")
+		return false
+	}
+	nodeConfPath := "/data/conflux/node.conf"
+	savePreviousNodeConf(nodeConfPath)
+	if err := writeDataFile(nodeConfPath, []byte(content)); err != nil {
+		Error("UPDATE", "写入 node.conf 失败: %v", err)
+		return false
+	}
+	Info("UPDATE", "成功写入 node.conf: %s (%d 行)", nodeConfPath, len(lines))
+	jobStageCount(len(written))
+	if _, err := refreshNodeConfDigest(nodeConfPath); err != nil {
+		Warn("UPDATE", "计算 node.conf 摘要失败: %v", err)
+	}
+	ctx.Written = make(map[string]int)
+	for _, node := range written {
+		ctx.Written[node.Source]++
 	}
+	writeNodesJSON(written)
+	gistsEnv := os.Getenv("GISTS")
+	if gistsEnv != "" {
+		syncGists(gistsEnv, nodeConfPath)
+	}
+	return true
 }
 
-// 新增：上传 node.conf 到 Gists
-// GISTS 环境变量格式示例：ghp_xxx@1234567890abcdef1234567890abcdef
-// 其中 ghp_xxx 是 GitHub Token，1234567890abcdef1234567890abcdef 是 Gist ID
-func uploadToGists(gistsEnv, filePath string) {
-	content, err := os.ReadFile(filePath)
+// 执行 POST_HOOK 后处理脚本：渲染后的配置通过 stdin 传入，stdout 作为新配置
+// 非零退出或超时（POST_HOOK_TIMEOUT，默认 10s）时记录错误并使用原内容
+func runPostHook(content string) string {
+	hook := os.Getenv("POST_HOOK")
+	if hook == "" {
+		return content
+	}
+	timeout := 10 * time.Second
+	if d, err := time.ParseDuration(os.Getenv("POST_HOOK_TIMEOUT")); err == nil && d > 0 {
+		timeout = d
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, hook)
+	cmd.Stdin = strings.NewReader(content)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		Error("UPDATE", "POST_HOOK 执行失败，使用原内容: %v %s", err, strings.TrimSpace(stderr.String()))
+		return content
+	}
+	Info("UPDATE", "POST_HOOK 执行完成: %s", hook)
+	return stdout.String()
+}
+
+// nodes.json 路径：与 node.conf 对应的结构化节点数据
+const nodesJSONPath = "/data/conflux/nodes.json"
+
+// 写入 nodes.json
+func writeNodesJSON(nodes []Node) {
+	data, err := json.MarshalIndent(nodes, "", "  ")
+	if err != nil {
+		Error("UPDATE", "序列化 nodes.json 失败: %v", err)
+		return
+	}
+	if err := writeDataFile(nodesJSONPath, data); err != nil {
+		Error("UPDATE", "写入 nodes.json 失败: %v", err)
+	}
+}
+
+// 读取 nodes.json
+func loadNodesJSON() ([]Node, error) {
+	data, err := readDataFile(nodesJSONPath)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []Node
+	if err := json.Unmarshal(data, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// 读取上次 nodes.json 中属于指定机场的节点，与 previousLines 对应
+func previousNodes(airports map[string]bool) []Node {
+	if len(airports) == 0 {
+		return nil
+	}
+	nodes, err := loadNodesJSON()
+	if err != nil {
+		return nil
+	}
+	var result []Node
+	for _, node := range nodes {
+		if airports[node.Source] {
+			result = append(result, node)
+		}
+	}
+	return result
+}
+
+// 写入 dropped.json：按机场列出被丢弃的节点名和原因
+func writeDropped(dropped map[string][]DropRecord) {
+	data, err := json.MarshalIndent(dropped, "", "  ")
+	if err != nil {
+		Error("UPDATE", "序列化 dropped.json 失败: %v", err)
+		return
+	}
+	if err := writeDataFile("/data/conflux/dropped.json", data); err != nil {
+		Error("UPDATE", "写入 dropped.json 失败: %v", err)
+	}
+}
+
+// 读取上次 node.conf 中属于指定机场的节点行
+func previousLines(airports map[string]bool) []string {
+	if len(airports) == 0 {
+		return nil
+	}
+	data, err := readDataFile("/data/conflux/node.conf")
+	if err != nil {
+		return nil
+	}
+	var result []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if airport := lineAirport(line); airports[airport] {
+			result = append(result, strings.TrimSpace(line))
+		}
+	}
+	for airport := range airports {
+		Info("UPDATE", "[%s] 沿用上次节点", airport)
+	}
+	return result
+}
+
+// 从 node.conf 行的节点名（机场名 [ISO]-序号）中提取机场名
+func lineAirport(line string) string {
+	name, _, ok := strings.Cut(line, " = ")
+	if !ok {
+		return ""
+	}
+	if idx := strings.LastIndex(name, " ["); idx != -1 {
+		return strings.TrimSpace(name[:idx])
+	}
+	return ""
+}
+
+// 从 node.conf 行的节点名（机场名 [ISO emoji]-序号）中提取 ISO
+func lineISO(line string) string {
+	name, _, ok := strings.Cut(line, " = ")
+	if !ok {
+		return ""
+	}
+	idx := strings.LastIndex(name, " [")
+	if idx == -1 {
+		return ""
+	}
+	iso := name[idx+2:]
+	end := 0
+	for end < len(iso) && (iso[end] >= 'A' && iso[end] <= 'Z' || iso[end] == '-') {
+		end++
+	}
+	return iso[:end]
+}
+
+// 记录最近一次成功上传到 Gists 的内容摘要
+const gistsSumPath = "/data/conflux/gists.sum"
+
+// 计算内容摘要（sha256 十六进制）
+func contentSum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// 补传检查：本地 node.conf 与最近一次成功上传的内容不一致时重新上传
+// 用于上次上传失败（如网络中断）后，即使本次更新内容未变化也能让 Gists 最终一致
+// GISTS_RETRY=0 时关闭补传
+func retryPendingGists() {
+	gistsEnv := os.Getenv("GISTS")
+	if gistsEnv == "" || os.Getenv("GISTS_RETRY") == "0" {
+		return
+	}
+	nodeConfPath := "/data/conflux/node.conf"
+	if _, err := dataFileModTime(nodeConfPath); err != nil {
+		return
+	}
+	if !gistsPending(nodeConfPath) {
+		return
+	}
+	Warn("GISTS", "检测到未成功上传的 node.conf，重新上传")
+	syncGists(gistsEnv, nodeConfPath)
+}
+
+// 判断 node.conf 是否与最近一次成功上传的内容不一致
+func gistsPending(filePath string) bool {
+	content, err := readDataFile(filePath)
+	if err != nil {
+		return false
+	}
+	last, err := readDataFile(gistsSumPath)
+	if err != nil {
+		return true
+	}
+	return strings.TrimSpace(string(last)) != contentSum(content)
+}
+
+// 同步 node.conf 到 Gists：内容未变化时跳过，上传成功后记录内容摘要
+func syncGists(gistsEnv, filePath string) {
+	if !gistsPending(filePath) {
+		Info("GISTS", "node.conf 内容未变化，跳过上传")
+		return
+	}
+	content, err := readDataFile(filePath)
 	if err != nil {
 		Error("GISTS", "读取 node.conf 失败: %v", err)
 		return
 	}
+	if !uploadToGists(gistsEnv, content) {
+		return
+	}
+	if err := writeDataFile(gistsSumPath, []byte(contentSum(content))); err != nil {
+		Error("GISTS", "写入上传记录失败: %v", err)
+	}
+}
+
+// 新增：上传 node.conf 到 Gists，返回是否上传成功
+// GISTS 环境变量格式示例：ghp_xxx@1234567890abcdef1234567890abcdef
+// 其中 ghp_xxx 是 GitHub Token，1234567890abcdef1234567890abcdef 是 Gist ID
+func uploadToGists(gistsEnv string, content []byte) bool {
 	// 构造 Gists API 请求体
 	body := map[string]interface{}{
 		"files": map[string]map[string]string{
@@ -339,7 +1235,7 @@ func uploadToGists(gistsEnv, filePath string) {
 	parts := strings.SplitN(gistsEnv, "@", 2)
 	if len(parts) != 2 {
 		Error("GISTS", "GISTS 环境变量格式错误，应为 token@gist_id")
-		return
+		return false
 	}
 	token, gistID := parts[0], parts[1]
 	url := "https://api.github.com/gists/" + gistID
@@ -349,13 +1245,14 @@ func uploadToGists(gistsEnv, filePath string) {
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		Error("GISTS", "上传 Gists 失败: %v", err)
-		return
+		return false
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
 		Info("GISTS", "成功上传 node.conf 到 Gists")
-	} else {
-		body, _ := io.ReadAll(resp.Body)
-		Error("GISTS", "上传 Gists 失败，状态码: %d, 响应: %s", resp.StatusCode, string(body))
+		return true
 	}
+	respBody, _ := io.ReadAll(resp.Body)
+	Error("GISTS", "上传 Gists 失败，状态码: %d, 响应: %s", resp.StatusCode, string(respBody))
+	return false
 }
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 测试期间使用内存模式，数据文件不写入 /data，结束后恢复
+func useMemoryStore(t *testing.T) {
+	t.Helper()
+	memMu.Lock()
+	prevOn, prevFiles := memOn, memFiles
+	memOn, memFiles = true, make(map[string]memFile)
+	memMu.Unlock()
+	t.Cleanup(func() {
+		memMu.Lock()
+		memOn, memFiles = prevOn, prevFiles
+		memMu.Unlock()
+	})
+}
+
+// 构造已通过检测的 ss 节点
+func testNode(source, iso, server string) Node {
+	return Node{
+		OriginName:  server,
+		Type:        "ss",
+		Server:      server,
+		Port:        "443",
+		Params:      map[string]string{"encrypt-method": "aes-128-gcm", "password": "p"},
+		ParamString: "encrypt-method=aes-128-gcm,password=p",
+		Source:      source,
+		ISO:         iso,
+		Emoji:       getEmojiByISO(iso),
+	}
+}
+
+func TestWriteNodeConfNameCollision(t *testing.T) {
+	const prevLine = "B [HK🇭🇰]-01 = ss,9.9.9.9,443, encrypt-method=aes-128-gcm,password=p"
+	tests := []struct {
+		name     string
+		prev     []string
+		retained map[string]bool
+		nodes    []Node
+		want     []string
+	}{
+		{
+			name:  "no collision",
+			nodes: []Node{testNode("A", "HK", "1.1.1.1"), testNode("A", "HK", "1.1.1.2"), testNode("A", "JP", "1.1.1.3")},
+			want:  []string{"A [HK🇭🇰]-01", "A [HK🇭🇰]-02", "A [JP🇯🇵]-01"},
+		},
+		{
+			name:     "collides with retained line",
+			prev:     []string{prevLine},
+			retained: map[string]bool{"B": true},
+			nodes:    []Node{testNode("B", "HK", "2.2.2.2")},
+			want:     []string{"B [HK🇭🇰]-01 #2", "B [HK🇭🇰]-01"},
+		},
+		{
+			name:     "suffix also taken",
+			prev:     []string{prevLine, "B [HK🇭🇰]-01 #2 = ss,9.9.9.8,443, encrypt-method=aes-128-gcm,password=p"},
+			retained: map[string]bool{"B": true},
+			nodes:    []Node{testNode("B", "HK", "2.2.2.2")},
+			want:     []string{"B [HK🇭🇰]-01 #3", "B [HK🇭🇰]-01", "B [HK🇭🇰]-01 #2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMemoryStore(t)
+			t.Setenv("GISTS", "")
+			t.Setenv("POST_HOOK", "")
+			t.Setenv("TAG_SUFFIX", "")
+			nodeConfPath := "/data/conflux/node.conf"
+			if len(tt.prev) > 0 {
+				if err := writeDataFile(nodeConfPath, []byte(strings.Join(tt.prev, "\n"))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ctx := &UpdateContext{
+				Nodes:        tt.nodes,
+				AirportStats: make(map[string]*Stat),
+				Retained:     tt.retained,
+				Dropped:      make(map[string][]DropRecord),
+			}
+			if !writeNodeConf(ctx) {
+				t.Fatal("writeNodeConf 未写入")
+			}
+			lines, err := nodeConfLines(nodeConfPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, line := range lines {
+				name, _, _ := strings.Cut(line, " = ")
+				names = append(names, name)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("节点名 = %q, want %q", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterParams(t *testing.T) {
+	const params = "encrypt-method=aes-128-gcm,password=p,udp-relay=true,tfo=true,sni=a.com"
+	tests := []struct {
+		name      string
+		whitelist string
+		blacklist string
+		want      string
+	}{
+		{"none", "", "", params},
+		{"whitelist only", "sni", "", "encrypt-method=aes-128-gcm,password=p,sni=a.com"},
+		{"blacklist only", "", "tfo, password", "encrypt-method=aes-128-gcm,password=p,udp-relay=true,sni=a.com"},
+		{"both", "sni,tfo", "tfo", "encrypt-method=aes-128-gcm,password=p,sni=a.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PARAM_WHITELIST", tt.whitelist)
+			t.Setenv("PARAM_BLACKLIST", tt.blacklist)
+			if got := filterParams(params); got != tt.want {
+				t.Errorf("filterParams = %q, want %q", got, tt.want)
+			}
+			// type/server/port 不属于参数，任何名单下都不会被丢弃
+			t.Setenv("CANONICAL_PARAMS", "")
+			t.Setenv("SHOW_TESTED", "")
+			node := testNode("A", "HK", "1.1.1.1")
+			node.ParamString = params
+			line := formatNode(node, "A [HK🇭🇰]-01")
+			if want := "A [HK🇭🇰]-01 = ss,1.1.1.1,443, " + tt.want; line != want {
+				t.Errorf("formatNode = %q, want %q", line, want)
+			}
+		})
+	}
+}
+
+func TestFormatNodeNoParams(t *testing.T) {
+	t.Setenv("PARAM_WHITELIST", "")
+	t.Setenv("PARAM_BLACKLIST", "")
+	t.Setenv("CANONICAL_PARAMS", "")
+	node := Node{Type: "http", Server: "1.1.1.1", Port: "8080", Params: map[string]string{}}
+
+	// 没有参数时行尾不带分隔符
+	t.Setenv("SHOW_TESTED", "")
+	if got, want := formatNode(node, "X"), "X = http,1.1.1.1,8080"; got != want {
+		t.Errorf("formatNode = %q, want %q", got, want)
+	}
+
+	// 只有检测时间时不带多余的逗号
+	t.Setenv("SHOW_TESTED", "1")
+	node.Tested = time.Unix(1700000000, 0)
+	if got, want := formatNode(node, "X"), "X = http,1.1.1.1,8080, tested=1700000000"; got != want {
+		t.Errorf("formatNode = %q, want %q", got, want)
+	}
+}
+
+func TestParseAllNodesParamPrecedence(t *testing.T) {
+	useMemoryStore(t)
+	t.Setenv("DEFAULT_PARAMS", "udp-relay=1,tfo=1,ecn=true")
+	t.Setenv("AIRPORT_PARAMS", "A:tfo=0,udp-relay=0")
+	t.Setenv("SERVER_REWRITE", "")
+	t.Setenv("PARAM_WHITELIST", "")
+	t.Setenv("PARAM_BLACKLIST", "")
+	t.Setenv("CANONICAL_PARAMS", "")
+	t.Setenv("SHOW_TESTED", "")
+	lines := []string{"[Proxy]", "HK 01 = ss, 1.2.3.4, 443, encrypt-method=aes-128-gcm, password=p, udp-relay=true"}
+	nodes := parseAllNodes(map[string][]string{"A": lines, "B": lines})
+	if len(nodes) != 2 {
+		t.Fatalf("解析出 %d 个节点", len(nodes))
+	}
+	want := map[string]map[string]string{
+		// 节点自身参数 > 机场参数 > 全局默认
+		"A": {"encrypt-method": "aes-128-gcm", "password": "p", "udp-relay": "true", "tfo": "0", "ecn": "true"},
+		"B": {"encrypt-method": "aes-128-gcm", "password": "p", "udp-relay": "true", "tfo": "1", "ecn": "true"},
+	}
+	for _, node := range nodes {
+		if !reflect.DeepEqual(node.Params, want[node.Source]) {
+			t.Errorf("[%s] Params = %v, want %v", node.Source, node.Params, want[node.Source])
+		}
+		// 补充的参数按名称排序追加，多次输出一致
+		first := formatNode(node, "X")
+		for i := 0; i < 20; i++ {
+			if got := formatNode(node, "X"); got != first {
+				t.Fatalf("[%s] 输出不稳定: %q != %q", node.Source, got, first)
+			}
+		}
+		if !strings.HasSuffix(first, ",ecn=true,tfo="+want[node.Source]["tfo"]) {
+			t.Errorf("[%s] formatNode = %q", node.Source, first)
+		}
+	}
+}
+
+func TestLoadAirportsDuplicates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub.conf")
+	conf := "# 同一文件内重复定义，以先出现的为准\nC=https://c1\nC=https://c2\nA=https://a-file\n"
+	if err := os.WriteFile(path, []byte(conf), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SUB", "A=https://a1||B=https://b||A=https://a2")
+	t.Setenv("SUB_FILE", path)
+
+	want := map[string]string{"A": "https://a1", "B": "https://b", "C": "https://c1"}
+	if got := loadAirports(); !reflect.DeepEqual(got, want) {
+		t.Errorf("loadAirports = %v, want %v", got, want)
+	}
+}
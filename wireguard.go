@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// wireguard.go
+// WireGuard 节点：Surge 中代理行只引用 [WireGuard 名称] 段，密钥和对端信息都在段内。
+// 解析时把段内容展开为节点参数，endpoint 作为节点的服务器和端口参与裂变、去重和检测；
+// node.conf 中仍保持单行格式，输出时再还原为代理行和对应的 [WireGuard] 段。
+
+// 段内单值参数（Surge 名称）
+var wireGuardKeys = []string{"private-key", "self-ip", "self-ip-v6", "dns-server", "mtu"}
+
+// peer 中的参数（Surge 名称）
+var wireGuardPeerKeys = []string{"public-key", "allowed-ips", "preshared-key", "keepalive", "reserved"}
+
+// 提取所有 [WireGuard 名称] 段，返回 map[段名]map[参数]值
+func extractWireGuardSections(lines []string) map[string]map[string]string {
+	sections := make(map[string]map[string]string)
+	var current map[string]string
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			current = nil
+			if name, ok := strings.CutPrefix(strings.TrimSuffix(line, "]"), "[WireGuard "); ok {
+				current = make(map[string]string)
+				sections[strings.TrimSpace(name)] = current
+			}
+			continue
+		}
+		if current == nil || line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, "="); ok {
+			current[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return sections
+}
+
+// 解析 WireGuard 代理行（名称 = wireguard, section-name=xxx），非 WireGuard 行返回 false
+func parseWireGuardLine(line, airport string, sections map[string]map[string]string) (Node, bool, error) {
+	name, rest, ok := strings.Cut(line, "=")
+	if !ok {
+		return Node{}, false, nil
+	}
+	parts := strings.Split(rest, ",")
+	if strings.TrimSpace(parts[0]) != "wireguard" {
+		return Node{}, false, nil
+	}
+	name = strings.TrimSpace(name)
+	sectionName := ""
+	var extra []string
+	for _, p := range parts[1:] {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if k == "section-name" {
+			sectionName = v
+		} else if k != "" {
+			extra = append(extra, strings.TrimSpace(p))
+		}
+	}
+	section, ok := sections[sectionName]
+	if !ok {
+		return Node{}, true, fmt.Errorf("缺少 [WireGuard %s] 段", sectionName)
+	}
+
+	peer := parsePeer(section["peer"])
+	host, port, ok := splitEndpoint(peer["endpoint"])
+	if !ok {
+		return Node{}, true, fmt.Errorf("peer 缺少 endpoint")
+	}
+	var params []string
+	for _, k := range wireGuardKeys {
+		if v := section[k]; v != "" {
+			params = append(params, k+"="+listParam(v))
+		}
+	}
+	for _, k := range wireGuardPeerKeys {
+		if v := peer[k]; v != "" {
+			params = append(params, k+"="+listParam(v))
+		}
+	}
+	return newNode(name, "wireguard", host, port, airport, append(params, extra...)), true, nil
+}
+
+// 解析 peer = (public-key = xxx, allowed-ips = "0.0.0.0/0, ::/0", endpoint = host:port, keepalive = 45)
+// 引号内的逗号不作为分隔符
+func parsePeer(s string) map[string]string {
+	s = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(s), "("), ")")
+	peer := make(map[string]string)
+	var fields []string
+	start, quoted := 0, false
+	for i, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			fields = append(fields, s[start:i])
+			start = i + 1
+		}
+	}
+	fields = append(fields, s[start:])
+	for _, f := range fields {
+		if k, v, ok := strings.Cut(f, "="); ok {
+			peer[strings.TrimSpace(k)] = strings.Trim(strings.TrimSpace(v), `"`)
+		}
+	}
+	return peer
+}
+
+// 拆分 endpoint（host:port 或 [ipv6]:port）
+func splitEndpoint(endpoint string) (string, string, bool) {
+	idx := strings.LastIndex(endpoint, ":")
+	if idx <= 0 || idx == len(endpoint)-1 {
+		return "", "", false
+	}
+	return strings.Trim(endpoint[:idx], "[]"), endpoint[idx+1:], true
+}
+
+// 列表参数中的逗号改为分号，保持 node.conf 单行格式
+func listParam(v string) string {
+	parts := strings.Split(v, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return strings.Join(parts, ";")
+}
+
+// 将 node.conf 中的 WireGuard 行还原为 Surge 代理行和 [WireGuard] 段，非 WireGuard 行返回 false
+// sectionName 由调用方保证唯一（节点名可能含有 ] 等字符，不能直接作为段名）
+func renderWireGuard(line, sectionName string) (string, string, bool) {
+	node, ok := parseNodeLine(line, "")
+	if !ok || node.Type != "wireguard" {
+		return line, "", false
+	}
+	proxy := fmt.Sprintf("%s = wireguard, section-name=%s", node.OriginName, sectionName)
+	for _, p := range strings.Split(node.ParamString, ",") {
+		k, _, _ := strings.Cut(p, "=")
+		if !isWireGuardKey(k) && p != "" {
+			proxy += ", " + p
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[WireGuard %s]\n", sectionName)
+	for _, k := range wireGuardKeys {
+		if v := node.Params[k]; v != "" {
+			fmt.Fprintf(&b, "%s = %s\n", k, strings.ReplaceAll(v, ";", ", "))
+		}
+	}
+	peer := []string{}
+	for _, k := range wireGuardPeerKeys {
+		v := node.Params[k]
+		switch {
+		case v == "":
+		case k == "allowed-ips":
+			peer = append(peer, fmt.Sprintf(`%s = "%s"`, k, strings.ReplaceAll(v, ";", ", ")))
+		default:
+			peer = append(peer, k+" = "+v)
+		}
+	}
+	endpoint := node.Server
+	if strings.Contains(endpoint, ":") {
+		endpoint = "[" + endpoint + "]"
+	}
+	peer = append(peer, "endpoint = "+endpoint+":"+node.Port)
+	fmt.Fprintf(&b, "peer = (%s)", strings.Join(peer, ", "))
+	return proxy, b.String(), true
+}
+
+// 判断是否为展开到节点参数中的 WireGuard 段参数
+func isWireGuardKey(k string) bool {
+	for _, key := range append(append([]string{}, wireGuardKeys...), wireGuardPeerKeys...) {
+		if key == k {
+			return true
+		}
+	}
+	return false
+}
+
+// 将 WireGuard 节点参数转换为 mihomo 写法
+func convertWireGuard(node *Node, proxyMap map[string]interface{}) {
+	rename := map[string]string{
+		"self-ip":       "ip",
+		"self-ip-v6":    "ipv6",
+		"preshared-key": "pre-shared-key",
+		"keepalive":     "persistent-keepalive",
+	}
+	for from, to := range rename {
+		if v, ok := proxyMap[from]; ok {
+			proxyMap[to] = v
+			delete(proxyMap, from)
+		}
+	}
+	for _, k := range []string{"dns-server", "allowed-ips"} {
+		if v := node.Params[k]; v != "" {
+			delete(proxyMap, k)
+			key := k
+			if k == "dns-server" {
+				key = "dns"
+			}
+			proxyMap[key] = strings.Split(v, ";")
+		}
+	}
+	proxyMap["udp"] = true
+}